@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+	"sort"
+	"strings"
+)
+
+// CheckProblem is a problem found by the check command. Line and column are 1-based, 0 means unknown
+type CheckProblem struct {
+	file    string
+	line    int
+	column  int
+	message string
+}
+
+func (problem CheckProblem) String() string {
+	if problem.file == "" {
+		return problem.message
+	}
+	if problem.line == 0 {
+		return fmt.Sprintf("%s: %s", problem.file, problem.message)
+	}
+	if problem.column == 0 {
+		return fmt.Sprintf("%s:%d: %s", problem.file, problem.line, problem.message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", problem.file, problem.line, problem.column, problem.message)
+}
+
+func newCheckProblem(err *ProcessingError) CheckProblem {
+	if err.token == nil {
+		return CheckProblem{message: err.message}
+	}
+	return CheckProblem{err.token.inputFile(), int(err.token.lineIndex) + 1, err.token.column(), err.description}
+}
+
+// checkCommand validates inputs without running lua blocks and writing outputs
+func checkCommand(arguments []string) {
+	loadInputs(arguments)
+	jobs := createAllProcessingJobs()
+	processor, err := newProcessor(luaFiles)
+	defer processor.close()
+	if err != nil {
+		fail(err.Error())
+	}
+
+	var problems []CheckProblem
+	for _, job := range jobs {
+		processor.macroMap = copyMacroMap(processor.librariesMacroMap)
+		for _, file := range job.inputs {
+			problems = append(problems, processor.checkFile(file)...)
+		}
+	}
+	for _, problem := range problems {
+		log(problem.String())
+	}
+	if len(problems) != 0 {
+		fail("Problems found:", len(problems))
+	}
+}
+
+func (p *Processor) checkFile(filePath string) []CheckProblem {
+	var content string
+	if err := runProcessing(func() { content = p.readFile(filePath) }); err != nil {
+		return []CheckProblem{newCheckProblem(err)}
+	}
+	return p.checkContent(content, inputDisplayName(filePath))
+}
+
+// checkContent tokenizes the text of the file, compiles lua blocks and matches arguments of macro invocations.
+// Macros declared in lua blocks are registered without running the blocks, see findMacroDeclaration.
+// The text can differ from the file on the disk when the file is edited
+func (p *Processor) checkContent(content string, filePath string) []CheckProblem {
+	var problems []CheckProblem
+	var tokens *TokenList
+	err := runProcessing(func() {
+		lexer := newLexer(content, filePath)
+		tokens = lexer.tokens
+		lexer.tokenize()
+	})
+	if err != nil {
+		problems = append(problems, newCheckProblem(err))
+	}
+	if tokens == nil {
+		return problems
+	}
+
+	for i := tokens.first(); i != noToken; i = tokens.next(i) {
+		token := tokens.get(i)
+		if token.tokenType == LuaBlock {
+			problems = append(problems, p.checkLuaBlock(token)...)
+		} else if token.tokenType == ESCAPE {
+			if nextIndex := tokens.next(i); nextIndex != noToken && p.isMacroToken(tokens.get(nextIndex)) {
+				i = nextIndex
+			}
+		} else if token.tokenType == SYMBOL {
+			macro, exists := p.macroMap[token.text()]
+			if !exists {
+				continue
+			}
+			if err := runProcessing(func() { matchArguments(tokens.next(i), tokens, token, &macro) }); err != nil {
+				problems = append(problems, newCheckProblem(err))
+			}
+		}
+	}
+	//lexer error is found first, but it is at the end of the file
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].line < problems[j].line })
+	return problems
+}
+
+func (p *Processor) checkLuaBlock(token *Token) []CheckProblem {
+	chunk, err := parse.Parse(strings.NewReader(token.text()), token.inputFile())
+	if err != nil {
+		return []CheckProblem{luaSyntaxProblem(token, err)}
+	}
+	if _, err := lua.Compile(chunk, token.inputFile()); err != nil {
+		return []CheckProblem{{token.inputFile(), int(token.lineIndex) + 1, token.column(), err.Error()}}
+	}
+
+	var problems []CheckProblem
+	for _, statement := range chunk {
+		name, argumentTypes, found := findMacroDeclaration(statement)
+		if !found {
+			continue
+		}
+		err := runProcessing(func() {
+			if _, exists := p.macroMap[name]; exists {
+				reportError(nil, "Macros with name [%s] already exists", name)
+			}
+			macro := newMacro(name, argumentTypes)
+			macro.definitionFile, macro.definitionLine = token.inputFile(), int(token.lineIndex)+statement.Line()
+			p.macroMap[name] = macro
+		})
+		if err != nil {
+			problems = append(problems, CheckProblem{token.inputFile(), int(token.lineIndex) + statement.Line(), 1, err.description})
+		}
+	}
+	return problems
+}
+
+// luaSyntaxProblem converts position of the syntax error inside lua block to the position in the file
+func luaSyntaxProblem(token *Token, err error) CheckProblem {
+	parseError, ok := err.(*parse.Error)
+	if !ok {
+		return CheckProblem{token.inputFile(), int(token.lineIndex) + 1, token.column(), err.Error()}
+	}
+	message := parseError.Message
+	if parseError.Token != "" {
+		message = fmt.Sprintf("%s near '%s'", message, parseError.Token)
+	}
+	if parseError.Pos.Line == parse.EOF {
+		return CheckProblem{token.inputFile(), int(token.lineIndex) + strings.Count(token.text(), "\n") + 1, 0, message + " at the end of lua block"}
+	}
+
+	column := parseError.Pos.Column
+	if parseError.Pos.Line == 1 {
+		column += token.column() - 1
+	}
+	return CheckProblem{token.inputFile(), int(token.lineIndex) + parseError.Pos.Line, column, message}
+}
+
+// findMacroDeclaration detects top level statements like macro("NAME", {"raw", "raw*"}, function(...) end),
+// so invocations of macros declared in templates can be checked without running lua code
+func findMacroDeclaration(statement ast.Stmt) (string, []string, bool) {
+	callStatement, ok := statement.(*ast.FuncCallStmt)
+	if !ok {
+		return "", nil, false
+	}
+	call, ok := callStatement.Expr.(*ast.FuncCallExpr)
+	if !ok || len(call.Args) < 2 {
+		return "", nil, false
+	}
+	function, ok := call.Func.(*ast.IdentExpr)
+	if !ok || function.Value != "macro" {
+		return "", nil, false
+	}
+	name, ok := call.Args[0].(*ast.StringExpr)
+	if !ok {
+		return "", nil, false
+	}
+	argumentsTable, ok := call.Args[1].(*ast.TableExpr)
+	if !ok {
+		return "", nil, false
+	}
+
+	var argumentTypes []string
+	for _, field := range argumentsTable.Fields {
+		argumentType, ok := field.Value.(*ast.StringExpr)
+		if field.Key != nil || !ok {
+			return "", nil, false
+		}
+		argumentTypes = append(argumentTypes, argumentType.Value)
+	}
+	return name.Value, argumentTypes, true
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckProblemString(t *testing.T) {
+	tests := []struct {
+		problem  CheckProblem
+		expected string
+	}{
+		{CheckProblem{"ck.tpl", 6, 3, "unknown macro"}, "ck.tpl:6:3: unknown macro"},
+		{CheckProblem{"ck.tpl", 6, 0, "syntax error"}, "ck.tpl:6: syntax error"},
+		{CheckProblem{"ck.tpl", 0, 0, "cannot read"}, "ck.tpl: cannot read"},
+		{CheckProblem{"", 0, 0, "no inputs"}, "no inputs"},
+	}
+	for _, test := range tests {
+		if result := test.problem.String(); result != test.expected {
+			t.Errorf("Expected [%s] but found [%s]", test.expected, result)
+		}
+	}
+}
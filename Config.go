@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultConfigPath is the project config file that is used when --config is not provided
+const defaultConfigPath = "luatp.json"
+
+var configPath string
+
+// selectedJobNames are names of config jobs provided with --job. All jobs are processed when it is empty
+var selectedJobNames []string
+
+var configJobs []ConfigJob
+
+// lineBaseProvided is set when --line-base is provided, so the config value is not used
+var lineBaseProvided = false
+
+// ConfigJob describes inputs and outputs of one job in the project config
+type ConfigJob struct {
+	Name    string   `json:"name"`
+	Inputs  []string `json:"inputs"`
+	Outputs []string `json:"outputs"`
+	OutDir  string   `json:"outDir"`
+	OutExt  *string  `json:"outExt"`
+	//directory of the config file. Paths of the job are relative to it
+	baseDirectory string
+}
+
+type ConfigDelimiters struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Config is the project config file. Inputs and outputs on the top level form a job without name
+type Config struct {
+	ConfigJob
+	Libraries      []string          `json:"libraries"`
+	Include        []string          `json:"include"`
+	Exclude        []string          `json:"exclude"`
+	Defines        map[string]string `json:"defines"`
+	Delimiters     *ConfigDelimiters `json:"delimiters"`
+	Escape         *string           `json:"escape"`
+	LineDirectives string            `json:"lineDirectives"`
+	LineBase       *int              `json:"lineBase"`
+	Sandbox        bool              `json:"sandbox"`
+	Jobs           []ConfigJob       `json:"jobs"`
+}
+
+// findConfigPath returns path of the config provided with --config, or luatp.json from the current directory if it exists
+func findConfigPath() string {
+	if configPath != "" {
+		if !checkFileExists(configPath) {
+			fail("Provided config file", configPath, "does not exists")
+		}
+		return configPath
+	}
+	if checkFileExists(defaultConfigPath) {
+		return defaultConfigPath
+	}
+	return ""
+}
+
+// loadProjectConfig applies the project config to the settings that were not provided on the command line
+func loadProjectConfig() {
+	filePath := findConfigPath()
+	if filePath == "" {
+		return
+	}
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		fail("Cannot read config file", filePath, err.Error())
+	}
+	var config Config
+	if err := json.Unmarshal(content, &config); err != nil {
+		fail("Cannot parse config file", filePath, err.Error())
+	}
+
+	baseDirectory := filepath.Dir(filePath)
+	if len(luaFiles) == 0 {
+		for _, libraryFilePath := range config.Libraries {
+			libraryFilePath = resolveConfigPath(baseDirectory, libraryFilePath)
+			if !checkFileExists(libraryFilePath) {
+				fail("Lua file", libraryFilePath, "from config file", filePath, "does not exists")
+			}
+			luaFiles = append(luaFiles, libraryFilePath)
+		}
+	}
+	if len(includePatterns) == 0 {
+		includePatterns = config.Include
+	}
+	if len(excludePatterns) == 0 {
+		excludePatterns = config.Exclude
+	}
+	for name, value := range config.Defines {
+		if _, exists := defines[name]; !exists {
+			defines[name] = value
+		}
+	}
+	if config.Delimiters != nil && !delimitersProvided {
+		setDelimiters(config.Delimiters.Start, config.Delimiters.End)
+	}
+	if config.Escape != nil && !escapeCharacterProvided {
+		setEscapeCharacter(*config.Escape)
+	}
+	if config.LineDirectives != "" && lineDirectiveFormat == "" {
+		lineDirectiveFormat = resolveLineDirectiveFormat(config.LineDirectives)
+	}
+	if config.LineBase != nil && !lineBaseProvided {
+		if *config.LineBase != 0 && *config.LineBase != 1 {
+			fail("Line base in config file", filePath, "should be 0 or 1")
+		}
+		lineBase = *config.LineBase
+	}
+	sandboxMode = sandboxMode || config.Sandbox
+
+	if len(filesToProcess) == 0 {
+		configJobs = selectConfigJobs(config, baseDirectory)
+	}
+}
+
+func resolveConfigPath(baseDirectory string, filePath string) string {
+	if filePath == stdinPath || filepath.IsAbs(filePath) || isConsolePath(filePath) {
+		return filePath
+	}
+	return filepath.Join(baseDirectory, filePath)
+}
+
+// selectConfigJobs returns jobs selected with --job with paths relative to the config file directory
+func selectConfigJobs(config Config, baseDirectory string) []ConfigJob {
+	jobs := config.Jobs
+	if len(config.Inputs) != 0 {
+		jobs = append([]ConfigJob{config.ConfigJob}, jobs...)
+	}
+
+	var result []ConfigJob
+	for _, name := range selectedJobNames {
+		if !containsConfigJob(jobs, name) {
+			fail("Job", name, "is not found in config file")
+		}
+	}
+	for _, job := range jobs {
+		if len(selectedJobNames) != 0 && !containsString(selectedJobNames, job.Name) {
+			continue
+		}
+		for i := range job.Inputs {
+			job.Inputs[i] = resolveConfigPath(baseDirectory, job.Inputs[i])
+		}
+		for i := range job.Outputs {
+			job.Outputs[i] = resolveConfigPath(baseDirectory, job.Outputs[i])
+		}
+		if job.OutDir != "" {
+			job.OutDir = resolveConfigPath(baseDirectory, job.OutDir)
+		}
+		job.baseDirectory = baseDirectory
+		result = append(result, job)
+	}
+	return result
+}
+
+func containsConfigJob(jobs []ConfigJob, name string) bool {
+	for _, job := range jobs {
+		if job.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// inputPaths returns inputs from the command line, or inputs of the config jobs, before directories and glob patterns are expanded
+func inputPaths() []string {
+	if len(filesToProcess) != 0 {
+		return filesToProcess
+	}
+	var paths []string
+	for _, configJob := range configJobs {
+		paths = append(paths, configJob.Inputs...)
+	}
+	return paths
+}
+
+// createAllProcessingJobs creates jobs from the command line inputs, or from the config jobs when there are no inputs on the command line.
+// Output flags from the command line override outputs of every config job
+func createAllProcessingJobs() []ProcessingJob {
+	if len(filesToProcess) != 0 {
+		jobs := createProcessingJobs(expandInputPaths(filesToProcess), outputFilePaths, outputDirectory, outputExtensionRewrite, ".")
+		checkOutputPaths(jobs)
+		return jobs
+	}
+
+	var jobs []ProcessingJob
+	for _, configJob := range configJobs {
+		outputs := configJob.Outputs
+		outDir := configJob.OutDir
+		baseDirectory := configJob.baseDirectory
+		outExt := outputExtensionRewrite
+		if configJob.OutExt != nil && !outputExtensionRewriteProvided {
+			outExt = *configJob.OutExt
+		}
+		if len(outputFilePaths) != 0 || outputDirectory != "" {
+			outputs = outputFilePaths
+			outDir = outputDirectory
+			baseDirectory = "."
+		}
+		for _, inputFilePath := range configJob.Inputs {
+			if inputFilePath == stdinPath {
+				useStdin()
+			}
+		}
+		jobs = append(jobs, createProcessingJobs(expandInputPaths(configJob.Inputs), outputs, outDir, outExt, baseDirectory)...)
+	}
+	checkOutputPaths(jobs)
+	return jobs
+}
+
+// addDefine adds define in form NAME=VALUE. Define without value is set to "1"
+func addDefine(define string) {
+	name, value := define, "1"
+	if separatorIndex := strings.Index(define, "="); separatorIndex != -1 {
+		name, value = define[:separatorIndex], define[separatorIndex+1:]
+	}
+	if name == "" {
+		fail("Define name should not be empty:", define)
+	}
+	defines[name] = value
+}
+
+// setEscapeCharacter changes the escape character. Empty value disables escaping
+func setEscapeCharacter(value string) {
+	if utf8.RuneCountInString(value) > 1 || strings.TrimSpace(value) != value {
+		fail("Escape character should be one non space character, but found", value)
+	}
+	//the lexer splits words at the escape character, so a letter would change words that contain it
+	if c, _ := utf8.DecodeRuneInString(value); unicode.IsLetter(c) || unicode.IsNumber(c) || c == '_' {
+		fail("Escape character should not be a letter, a digit or '_', but found", value)
+	}
+	escapeCharacter = value
+}
+
+// setDelimiters changes lua block markers
+func setDelimiters(start string, end string) {
+	if strings.TrimSpace(start) == "" || strings.TrimSpace(end) == "" {
+		fail("Lua block delimiters should not be empty")
+	}
+	luaStartBlockMarker = start
+	luaEndBlockMarker = end
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"github.com/yuin/gopher-lua"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dependency file options (-M, -MD, -MF, -MT)
+var dependenciesOnly = false
+var writeDependencies = false
+var dependencyFilePath string
+var dependencyTarget string
+
+// DependencyTracker holds files that were read, in order of the first access
+type DependencyTracker struct {
+	files []string
+	known map[string]bool
+}
+
+type DependencyRule struct {
+	targets       []string
+	prerequisites []string
+	//output of the job, -MD without -MF writes the rule next to it
+	outputPath string
+}
+
+func newDependencyTracker(initialFiles []string) *DependencyTracker {
+	tracker := &DependencyTracker{known: make(map[string]bool)}
+	for _, filePath := range initialFiles {
+		tracker.add(filePath)
+	}
+	return tracker
+}
+
+func (t *DependencyTracker) add(filePath string) {
+	if !t.known[filePath] {
+		t.known[filePath] = true
+		t.files = append(t.files, filePath)
+	}
+}
+
+// createDependencyRule creates rule where the job outputs depend on every file read by the job, including lua files
+func createDependencyRule(outputPath string, divertedOutputs []string, prerequisites []string) DependencyRule {
+	target := outputPath
+	if dependencyTarget != "" {
+		target = dependencyTarget
+	}
+	if isConsolePath(target) {
+		reportError(nil, "Cannot write dependency rule for output to console. Provide -o or -MT flag")
+	}
+
+	return DependencyRule{append([]string{target}, divertedOutputs...), prerequisites, outputPath}
+}
+
+// escapeMakePath escapes characters that have special meaning in Makefile rules
+func escapeMakePath(filePath string) string {
+	filePath = strings.ReplaceAll(filePath, "$", "$$")
+	filePath = strings.ReplaceAll(filePath, "#", "\\#")
+	filePath = strings.ReplaceAll(filePath, " ", "\\ ")
+	return filePath
+}
+
+func writeDependencyRules(rules []DependencyRule, writer *bufio.Writer) {
+	for _, rule := range rules {
+		for i, target := range rule.targets {
+			if i > 0 {
+				_, _ = writer.WriteString(" ")
+			}
+			_, _ = writer.WriteString(escapeMakePath(target))
+		}
+		_, _ = writer.WriteString(":")
+		for _, prerequisite := range rule.prerequisites {
+			_, _ = writer.WriteString(" \\\n  " + escapeMakePath(prerequisite))
+		}
+		_, _ = writer.WriteString("\n")
+	}
+}
+
+// checkDependencyFileOutputs fails when -MD without -MF should write the rule next to output to console,
+// because the rule would be mixed with the output or written to a file named after the console
+func checkDependencyFileOutputs(jobs []ProcessingJob) {
+	if !writeDependencies || dependenciesOnly || dependencyFilePath != "" {
+		return
+	}
+	for _, job := range jobs {
+		if isConsolePath(job.outputPath) {
+			fail("Flag -MD writes the dependency rule next to the output file, but the output is console. Provide -MF flag")
+		}
+	}
+}
+
+// writeDependencyFile writes collected rules to -MF file. Without -MF, -M writes to console and -MD writes every rule next to its output
+func writeDependencyFile(rules []DependencyRule) {
+	if !dependenciesOnly && !writeDependencies {
+		return
+	}
+
+	if dependencyFilePath == "" && !dependenciesOnly {
+		//every job has its own output, so its rule goes to its own file, like compilers do for every object file
+		for _, rule := range rules {
+			writeDependencyRulesToFile([]DependencyRule{rule}, rule.outputPath+".d")
+		}
+		return
+	}
+	if dependencyFilePath == "" || isConsolePath(dependencyFilePath) {
+		writer := bufio.NewWriter(os.Stdout)
+		writeDependencyRules(rules, writer)
+		_ = writer.Flush()
+		return
+	}
+	writeDependencyRulesToFile(rules, dependencyFilePath)
+}
+
+func writeDependencyRulesToFile(rules []DependencyRule, filePath string) {
+	file := createOutputFile(filePath)
+	writer := bufio.NewWriter(file)
+	writeDependencyRules(rules, writer)
+	_ = writer.Flush()
+	_ = file.Close()
+}
+
+// trackLuaFileFunction wraps lua function that receives file path as first argument to record the file as dependency
+func (p *Processor) trackLuaFileFunction(functionName string) {
+	luaState := p.luaState
+	originalFunction, ok := luaState.GetGlobal(functionName).(*lua.LFunction)
+	if !ok {
+		return
+	}
+	luaState.SetGlobal(functionName, luaState.NewFunction(func(L *lua.LState) int {
+		filePath, ok := L.Get(1).(lua.LString)
+		if ok {
+			p.dependencies.add(string(filePath))
+		}
+		argumentsCount := L.GetTop()
+		L.Push(originalFunction)
+		for i := 1; i <= argumentsCount; i++ {
+			L.Push(L.Get(i))
+		}
+		L.Call(argumentsCount, lua.MultRet)
+		return L.GetTop() - argumentsCount
+	}))
+}
+
+// trackRequiredFiles wraps the loader of lua modules in package.loaders to record files loaded with require as dependencies.
+// The file is found the same way the loader finds it, with templates from package.path
+func (p *Processor) trackRequiredFiles() {
+	luaState := p.luaState
+	loaders, ok := luaState.GetField(luaState.GetGlobal("package"), "loaders").(*lua.LTable)
+	if !ok {
+		return
+	}
+	//the first loader returns modules from package.preload, the second one loads lua files
+	originalLoader, ok := loaders.RawGetInt(2).(*lua.LFunction)
+	if !ok {
+		return
+	}
+	loaders.RawSetInt(2, luaState.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		if packagePath, ok := L.GetField(L.GetGlobal("package"), "path").(lua.LString); ok {
+			modulePath := strings.ReplaceAll(name, ".", string(os.PathSeparator))
+			for _, pattern := range strings.Split(string(packagePath), ";") {
+				filePath := strings.ReplaceAll(pattern, "?", modulePath)
+				if _, err := os.Stat(filePath); err == nil {
+					p.dependencies.add(filepath.Clean(filePath))
+					break
+				}
+			}
+		}
+		L.Push(originalLoader)
+		L.Push(lua.LString(name))
+		L.Call(1, 1)
+		return 1
+	}))
+}
+
+func (p *Processor) AddDependency(L *lua.LState) int {
+	L.CheckString(1)
+	p.dependencies.add(L.ToString(1))
+	return 0
+}
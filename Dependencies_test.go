@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRequiredFilesAreDependencies(t *testing.T) {
+	directory := t.TempDir()
+	modulePath := filepath.Join(directory, "reqmod.lua")
+	if err := os.WriteFile(modulePath, []byte("return 1\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	processor, err := newProcessor(nil)
+	defer processor.close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	code := `package.path = "` + filepath.ToSlash(directory) + `/?.lua" require("reqmod")`
+	if err := processor.runLuaChunk(code, "test.lua", 0); err != nil {
+		t.Fatal(processor.describeLuaError(err))
+	}
+	if !containsString(processor.dependencies.files, modulePath) {
+		t.Errorf("Dependencies %v do not contain %s", processor.dependencies.files, modulePath)
+	}
+}
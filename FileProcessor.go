@@ -1,418 +1,498 @@
 package main
 
 import (
-	"bufio"
-	"container/list"
 	"fmt"
 	"github.com/yuin/gopher-lua"
+	"io"
 	"io/ioutil"
 	"os"
-	"strconv"
+	"regexp"
 	"strings"
-	"unicode"
+	"sync"
 )
 
-const luaStartBlockMarker = "<?lua"
-const luaEndBlockMarker = "lua?>"
+// stdinPath used as input or lua file path means standard input, and as output path means standard output
+const stdinPath = "-"
 
-var content string
-var contentLength int
-var currentPosition = 0
-var currentLineNumber = 0
-var currentFile string
+var stdinName = "<stdin>"
+var stdinContent *string
+var stdinMutex sync.Mutex
 
-var charsStack *CharsStack
+// parallelJobsCount is the maximum number of jobs that are processed at the same time
+var parallelJobsCount = 1
 
-var markedBlocks = make(map[string]*Token)
-var macroMap = make(map[string]MacroStruct)
-var generateLineInfoCallback *lua.LFunction
+// defines are lua global string variables that are set before lua files are executed
+var defines = make(map[string]string)
 
-type includePredicate func(rune) bool
+// delimitersProvided is set when lua block delimiters are provided on the command line, so the config value is not used
+var delimitersProvided = false
+
+// preserveLines makes output line N correspond to input line N. Lua blocks and multi-line macro invocations are padded with new lines
+var preserveLines = false
+
+// streamMode makes processor read inputs by chunks and write tokens as soon as no open marked block can receive text
+var streamMode = false
 
 type MacroStruct struct {
 	name      string
 	arguments []string
 	variadic  bool
 	callback  *lua.LFunction
+	//location of the macro() call, line is 1-based
+	definitionFile string
+	definitionLine int
+}
+
+// Processor executes inputs with its own lua state, so several processors can work in parallel
+type Processor struct {
+	luaState     *lua.LState
+	markedBlocks map[string]*Token
+	//marked blocks that were not closed with closeBlock. Streaming mode cannot write tokens while there are open blocks
+	openBlocks               map[string]bool
+	macroMap                 map[string]MacroStruct
+	generateLineInfoCallback *lua.LFunction
+	outputs                  *OutputSet
+	outputStack              []string
+	currentOutput            string
+	dependencies             *DependencyTracker
+	//macro or lua block that is executed now and the output when it started. Text written after beginOutput in the same
+	//macro or lua block goes to the diverted output
+	currentProducer *Producer
+	producerOutput  string
+	//text written by the current producer, collected for --trace
+	emittedText strings.Builder
+	warnings    []Warning
+	//names of expanded macros and locations of the first getMarkedBlock call for every block that was not marked yet, used by warnings
+	usedMacros         map[string]bool
+	missedBlockLookups map[string]SourceLocation
+	//token list and index of the token that is executed now. Tokens after it are searched for blocks that are marked later
+	executedTokens     *TokenList
+	executedTokenIndex int
+	//number of input lines spanned by lua blocks and macro invocations, by the token that receives their output. Used by --preserve-lines
+	spannedLines map[*Token]int
+
+	//macros declared by lua files. They are not reported as unused, and check and lsp start every file from them
+	librariesMacroMap map[string]MacroStruct
+}
+
+type JobResult struct {
+	err             *ProcessingError
+	outputs         *OutputSet
+	dependencyFiles []string
+	warnings        []Warning
+}
+
+// processFiles processes all jobs and returns every file that was read, even if processing failed
+func processFiles(luaFiles []string, jobs []ProcessingJob) ([]string, *ProcessingError) {
+	results := make([]JobResult, len(jobs))
+	workersCount := parallelJobsCount
+	if workersCount > len(jobs) {
+		workersCount = len(jobs)
+	}
+
+	if workersCount <= 1 {
+		processJobsSequentially(luaFiles, jobs, results)
+	} else {
+		processJobsInParallel(luaFiles, jobs, results, workersCount)
+	}
+	return collectJobResults(jobs, results)
 }
 
-type CharsStack struct {
-	chars []rune
-}
-
-func (c *CharsStack) push(char rune) {
-	c.chars = append(c.chars, char)
-}
-
-func (c *CharsStack) pop() rune {
-	n := len(c.chars) - 1
-	result := c.chars[n]
-	c.chars[n] = 0
-	c.chars = c.chars[:n]
-	return result
-}
-
-func (c *CharsStack) peek() rune {
-	n := len(c.chars) - 1
-	result := c.chars[n]
-	return result
+// processJobsSequentially processes every job, even if some of them fail, like processJobsInParallel does
+func processJobsSequentially(luaFiles []string, jobs []ProcessingJob, results []JobResult) {
+	for i, job := range jobs {
+		results[i] = processJobWithNewProcessor(luaFiles, job)
+	}
 }
 
-func (c *CharsStack) length() int {
-	return len(c.chars)
-}
+// processJobsInParallel processes jobs by several workers
+func processJobsInParallel(luaFiles []string, jobs []ProcessingJob, results []JobResult, workersCount int) {
+	jobIndexes := make(chan int)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < workersCount; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for jobIndex := range jobIndexes {
+				results[jobIndex] = processJobWithNewProcessor(luaFiles, jobs[jobIndex])
+			}
+		}()
+	}
 
-func (c *CharsStack) isEmpty() bool {
-	return len(c.chars) == 0
+	for i := range jobs {
+		jobIndexes <- i
+	}
+	close(jobIndexes)
+	waitGroup.Wait()
 }
 
-const (
-	EOF             = -1
-	WHITESPACE      = 1
-	SYMBOL          = 2
-	LUA_BLOCK_START = 3
-	LUA_BLOCK_END   = 4
-	LuaBlock        = 5
-	SPECIAL         = 6
-	UNKNOWN         = 7
-	NUMBER          = 8
-)
-
-type Token struct {
-	tokenType int
-	value     string
-	lineIndex int
-	inputFile string
+// processJobWithNewProcessor processes the job in its own lua state with preloaded lua files, so lua globals set by one job
+// are not visible in the others and the result does not depend on the number of workers
+func processJobWithNewProcessor(luaFiles []string, job ProcessingJob) JobResult {
+	processor, err := newProcessor(luaFiles)
+	defer processor.close()
+	if err != nil {
+		return JobResult{err: err, dependencyFiles: processor.dependencies.files}
+	}
+	return processor.processJob(job)
 }
 
-func (token *Token) String() string {
-	return fmt.Sprintf("%d-\"%s\"", token.tokenType, token.value)
-}
+// collectJobResults writes buffered outputs and dependency rules in order of jobs, so the result does not depend on the number of workers
+func collectJobResults(jobs []ProcessingJob, results []JobResult) ([]string, *ProcessingError) {
+	var errorMessages []string
+	var rules []DependencyRule
+	dependencyFiles := newDependencyTracker(nil)
+	divertedFiles := newDivertedFiles()
+	sourceMap := newSourceMap()
+	for i, result := range results {
+		for _, filePath := range result.dependencyFiles {
+			dependencyFiles.add(filePath)
+		}
 
-func checkCurrentBufferContainsString(str string) bool {
-	var tempStack CharsStack
-	matched := true
-	for i := 0; i < len(str); i++ {
-		c, success := getChar(true)
-		if success == false {
-			matched = false
-			break
+		err := result.err
+		if err == nil {
+			err = collectWarnings(result.warnings)
+		}
+		if err == nil && result.outputs != nil {
+			err = runProcessing(func() {
+				result.outputs.writeBuffered(divertedFiles)
+				if sourceMapPath != "" {
+					sourceMap.addOutputs(result.outputs)
+				}
+				if dependenciesOnly || writeDependencies {
+					rules = append(rules, createDependencyRule(jobs[i].outputPath, result.outputs.order, result.dependencyFiles))
+				}
+			})
+		}
+		if err != nil && !containsString(errorMessages, err.message) {
+			errorMessages = append(errorMessages, err.message)
 		}
+	}
+	divertedFiles.closeAll()
 
-		tempStack.push(c)
-		if c != rune(str[i]) {
-			matched = false
-			break
+	if len(errorMessages) == 0 {
+		if err := runProcessing(func() {
+			writeDependencyFile(rules)
+			if sourceMapPath != "" {
+				writeSourceMapFile(sourceMap)
+			}
+		}); err != nil {
+			errorMessages = append(errorMessages, err.message)
 		}
 	}
-	//return chars back
-	for !tempStack.isEmpty() {
-		unGetChar(tempStack.pop())
+	if len(errorMessages) != 0 {
+		return dependencyFiles.files, &ProcessingError{message: strings.Join(errorMessages, "\n")}
 	}
-
-	return matched
+	return dependencyFiles.files, nil
 }
 
-func eof() bool {
-	if !charsStack.isEmpty() {
-		return false
+// newProcessor creates lua state and executes lua files. Processor is returned even if lua files failed, to report files that were read
+func newProcessor(luaFiles []string) (*Processor, *ProcessingError) {
+	processor := &Processor{
+		luaState:           lua.NewState(),
+		markedBlocks:       make(map[string]*Token),
+		openBlocks:         make(map[string]bool),
+		spannedLines:       make(map[*Token]int),
+		macroMap:           make(map[string]MacroStruct),
+		dependencies:       newDependencyTracker(nil),
+		usedMacros:         make(map[string]bool),
+		missedBlockLookups: make(map[string]SourceLocation),
 	}
-	return currentPosition >= contentLength
-}
-
-func skipChars(count int) {
-	for i := 0; i < count; i++ {
-		getChar(true)
+	if sandboxMode {
+		applySandbox(processor.luaState)
 	}
-}
-
-func readTokenWhilePredicate(tokenType int, predicate includePredicate) *Token {
-	var result strings.Builder
-	lineNumber := currentLineNumber
-	for !eof() {
-		c, success := getChar(true)
-		if !success {
-			break
-		}
-		if predicate(c) {
-			result.WriteRune(c)
-		} else {
-			unGetChar(c)
-			break
-		}
+	processor.registerFunctions()
+	for name, value := range defines {
+		processor.luaState.SetGlobal(name, lua.LString(value))
 	}
 
-	return &Token{tokenType, result.String(), lineNumber, currentFile}
-}
-
-func readTokenUntilString(tokenType int, untilString string) *Token {
-	startSymbol := rune(untilString[0])
-	lineNumber := currentLineNumber
-	found := false
-	var result strings.Builder
-	for !eof() {
-		tempChar, _ := getChar(false)
-		if startSymbol == tempChar {
-			if checkCurrentBufferContainsString(untilString) {
-				found = true
-				break
+	err := runProcessing(func() {
+		//Execute lua files
+		for _, file := range luaFiles {
+			fileContent := processor.readFile(file)
+			if err := processor.runLuaChunk(fileContent, inputDisplayName(file), 0); err != nil {
+				reportError(nil, "Error while processing lua file:%s\n%s", inputDisplayName(file), processor.describeLuaError(err))
 			}
 		}
-
-		c, success := getChar(true)
-		if !success {
-			break
-		}
-		result.WriteRune(c)
-	}
-	if found {
-		return &Token{tokenType, result.String(), lineNumber, currentFile}
-	}
-
-	return &Token{UNKNOWN, result.String(), lineNumber, currentFile}
-}
-
-func readWhitespaceToken() *Token {
-	return readTokenWhilePredicate(WHITESPACE, func(c rune) bool {
-		return unicode.IsSpace(c)
 	})
-}
 
-func readNumberToken() *Token {
-	return readTokenWhilePredicate(NUMBER, func(c rune) bool {
-		return unicode.IsNumber(c) || c == '.'
-	})
+	processor.librariesMacroMap = copyMacroMap(processor.macroMap)
+	return processor, err
 }
 
-func readPunctToken() *Token {
-	return readTokenWhilePredicate(SPECIAL, func(c rune) bool {
-		return unicode.IsPunct(c)
-	})
+func (p *Processor) close() {
+	p.luaState.Close()
 }
 
-func readSymbolToken() *Token {
-	return readTokenWhilePredicate(SYMBOL, func(c rune) bool {
-		return unicode.IsLetter(c) || unicode.IsNumber(c) || c == '_'
+// processJob processes inputs of the job. Every job has its own processor, see processJobWithNewProcessor
+func (p *Processor) processJob(job ProcessingJob) JobResult {
+	err := runProcessing(func() {
+		p.outputs = newOutputSet(job.outputPath)
+		defer p.outputs.closeMain()
+		for _, file := range job.inputs {
+			p.processFile(file)
+		}
+		p.checkJobWarnings()
 	})
+	return JobResult{err, p.outputs, p.dependencies.files, p.warnings}
 }
 
-func debugPrint(tokens *list.List, currentNode *list.Element) {
-	debugEnabled := false
-	if debugEnabled {
-		for e := tokens.Front(); e != nil; e = e.Next() {
-			token := e.Value.(*Token)
-			str := strings.Replace(token.value, "\n", " ", -1)
-			str = strings.Replace(str, "\r", " ", -1)
-			if e == currentNode {
-				print("[^" + strconv.Itoa(token.tokenType) + " #" + strconv.Itoa(token.lineIndex) + " " + str + "]")
-			} else {
-				print("[" + strconv.Itoa(token.tokenType) + " #" + strconv.Itoa(token.lineIndex) + " " + str + "]")
-			}
-		}
-		print("\n")
+func copyMacroMap(source map[string]MacroStruct) map[string]MacroStruct {
+	result := make(map[string]MacroStruct, len(source))
+	for name, macro := range source {
+		result[name] = macro
 	}
+	return result
 }
 
-func flushAndClose(writer *bufio.Writer, file *os.File) {
-	_ = writer.Flush()
-	_ = file.Close()
-}
-
-func processFiles(luaFiles []string, filesToProcess []string, outputFilePath string) {
+func (p *Processor) readFile(filePath string) string {
+	if filePath == stdinPath {
+		return readStdin()
+	}
+	p.dependencies.add(filePath)
+	fileByteContent, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		reportError(nil, "Cannot read file %s", filePath)
+	}
 
-	luaState := lua.NewState()
-	registerFunctions(luaState)
-	defer luaState.Close()
+	return string(fileByteContent)
+}
 
-	var writer *bufio.Writer
-	if outputFilePath == "console" {
-		writer = bufio.NewWriter(os.Stdout)
-	} else {
-		myFile, err := os.Create(outputFilePath)
+// readStdin reads the whole standard input. The content is cached, because stdin can be read only once, but it is used by every worker and every watch cycle
+func readStdin() string {
+	stdinMutex.Lock()
+	defer stdinMutex.Unlock()
+	if stdinContent == nil {
+		content, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
-			panic(err)
+			reportError(nil, "Cannot read standard input\n%s", err.Error())
 		}
-		writer = bufio.NewWriter(myFile)
-		defer flushAndClose(writer, myFile)
-	}
-	//Execute lua files
-	for _, file := range luaFiles {
-		fileContent := readFile(file)
-		if err := luaState.DoString(fileContent); err != nil {
-			log("Error while processing lua file:" + file + "\n" + err.Error())
-			os.Exit(1)
-			//reportErrorAndExit(nil, "")
-			//panic(err)
-		}
-	}
-
-	for _, file := range filesToProcess {
-		currentFile = file
-		processFile(readFile(file), luaState, writer)
-		currentFile = ""
+		stringContent := string(content)
+		stdinContent = &stringContent
 	}
+	return *stdinContent
 }
 
-func readFile(filePath string) string {
-	fileByteContent, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		fail("Cannot read file", filePath)
+// inputDisplayName returns the file name that is shown in error messages and passed to line information callback
+func inputDisplayName(filePath string) string {
+	if filePath == stdinPath {
+		return stdinName
 	}
+	return filePath
+}
 
-	return string(fileByteContent)
+func isConsolePath(filePath string) bool {
+	return filePath == "console" || filePath == stdinPath
 }
 
-func processFile(fileContent string, luaState *lua.LState, writer *bufio.Writer) {
-	initFileProcessing(fileContent)
-	allTokens := list.New()
-	for !eof() {
-		tokens := getNextToken()
-		tokensCount := len(tokens)
-		if tokensCount == 0 {
-			break
-		}
+func (p *Processor) processFile(filePath string) {
+	if streamMode {
+		p.processFileStreaming(filePath)
+		return
+	}
+	lexer := newLexer(p.readFile(filePath), inputDisplayName(filePath))
+	allTokens := lexer.tokenize()
+	traceTokens(allTokens, inputDisplayName(filePath), "before")
 
-		if tokens[0].tokenType == EOF {
-			break
-		}
+	p.resetOutputStack()
+	p.executeTokens(allTokens)
+	traceTokens(allTokens, inputDisplayName(filePath), "after")
+	p.writeTokens(allTokens, noToken)
+}
 
-		for i := 0; i < tokensCount; i++ {
-			allTokens.PushBack(tokens[i])
+// processFileStreaming tokenizes the file while it is executed, so the whole file is never kept in memory.
+// Blocks of the previous file were already written, so they cannot hold the output of this file
+func (p *Processor) processFileStreaming(filePath string) {
+	var reader io.Reader = os.Stdin
+	if filePath != stdinPath {
+		p.dependencies.add(filePath)
+		file, err := os.Open(filePath)
+		if err != nil {
+			reportError(nil, "Cannot read file %s", filePath)
 		}
+		defer file.Close()
+		reader = file
 	}
+	lexer := newStreamLexer(reader, inputDisplayName(filePath))
 
-	executeTokens(allTokens, luaState)
-	dumpToString(allTokens, writer, luaState)
-}
-
-func initFileProcessing(fileContent string) {
-	charsStack = new(CharsStack)
-	content = fileContent
-	contentLength = len(content)
-	currentPosition = 0
-	currentLineNumber = 0
+	p.openBlocks = make(map[string]bool)
+	p.resetOutputStack()
+	p.executeTokens(lexer.tokens)
+	p.writeTokens(lexer.tokens, noToken)
 }
 
-func writeLineInformation(currentLineIndex int, currentFilePath string, writer *bufio.Writer, L *lua.LState) {
-	if generateLineInfoCallback != nil {
-		L.Push(generateLineInfoCallback)
+// writeLineInformation writes line information with the lua callback. Without the callback the --line-directives format is used
+func (p *Processor) writeLineInformation(currentLineIndex int, currentFilePath string, target *OutputTarget) {
+	if p.generateLineInfoCallback != nil {
+		L := p.luaState
+		L.Push(p.generateLineInfoCallback)
 		L.Push(lua.LNumber(currentLineIndex))
 		L.Push(lua.LString(currentFilePath))
-		L.Call(2, 1)
+		if err := L.PCall(2, 1, nil); err != nil {
+			reportError(nil, "Error in line information callback for line %d of %s\n%s", currentLineIndex+1, currentFilePath, p.describeLuaError(err))
+		}
 		returnValue := L.Get(-1).String()
 		L.Pop(1)
-		_, _ = writer.WriteString(returnValue + "\n")
+		target.write(returnValue+"\n", "", 0, nil)
+	} else if lineDirectiveFormat != "" {
+		target.write(formatLineDirective(currentLineIndex, currentFilePath)+"\n", "", 0, nil)
 	}
 }
 
-func dumpToString(tokens *list.List, writer *bufio.Writer, L *lua.LState) {
-	actualLineIndex := 0
-	currentFile = ""
-	for e := tokens.Front(); e != nil; e = e.Next() {
-		token := e.Value.(*Token)
+// writeTokens writes tokens that were not written yet, up to lastIndex inclusive. noToken writes all tokens.
+// Written tokens are released from the list
+func (p *Processor) writeTokens(tokens *TokenList, lastIndex int) {
+	i := tokens.first()
+	for ; i != noToken && (lastIndex == noToken || i <= lastIndex); i = tokens.next(i) {
+		token := tokens.get(i)
+		token.written = true
 		if !(token.tokenType == LUA_BLOCK_START || token.tokenType == LUA_BLOCK_END || token.tokenType == LuaBlock) {
-			if actualLineIndex != token.lineIndex || currentFile != token.inputFile {
-				writeLineInformation(token.lineIndex, token.inputFile, writer, L)
-				actualLineIndex = token.lineIndex
-				currentFile = token.inputFile
+			target := p.outputs.target(token.output)
+			lineIndex := int(token.lineIndex)
+			newLinesCount := 0
+			for chunkIndex, chunk := range token.textChunks() {
+				producer := token.producer(chunkIndex)
+				if output := token.chunkOutput(chunkIndex); output != token.output {
+					//text diverted by the macro or lua block does not take lines of the token output, so it is not counted for the padding
+					p.writeText(p.outputs.target(output), chunk, producer.Source, producer.Line-1, producer)
+					continue
+				}
+				if producer == nil {
+					p.writeText(target, chunk, token.inputFile(), lineIndex, nil)
+					lineIndex += strings.Count(chunk, "\n")
+				} else {
+					p.writeText(target, chunk, producer.Source, producer.Line-1, producer)
+				}
+				newLinesCount += strings.Count(chunk, "\n")
 			}
-			_, _ = writer.WriteString(token.value)
-			linesCount := countNewLines(token.value)
-			actualLineIndex += linesCount
+			p.writeLinesPadding(target, token, lineIndex, newLinesCount)
 		}
 	}
-	_ = writer.Flush()
-}
-
-func countNewLines(strValue string) int {
-	newLinesCount := 0
-	for _, _rune := range strValue {
-		if _rune == '\n' {
-			newLinesCount++
-		}
+	if lastIndex == noToken {
+		p.outputs.flushAll()
+		tokens.release(tokens.len())
+	} else {
+		tokens.release(lastIndex + 1)
 	}
-	return newLinesCount
 }
 
-func getNextToken() []*Token {
-	c, success := getChar(false)
-	if !success {
-		return []*Token{{EOF, "", currentLineNumber, currentFile}}
-	}
-	if unicode.IsSpace(c) {
-		return []*Token{readWhitespaceToken()}
-	}
-	if unicode.IsNumber(c) {
-		return []*Token{readNumberToken()}
+// writeLinesPadding writes new lines that were removed together with lua block or macro invocation.
+// Output that already has as many lines as the input it replaced gets no padding. Output with more lines moves the following lines down,
+// so the next paddings are shortened until the output catches up with the input
+func (p *Processor) writeLinesPadding(target *OutputTarget, token *Token, lineIndex int, newLinesCount int) {
+	spannedLinesCount, exists := p.spannedLines[token]
+	if !exists {
+		return
 	}
-	if c == '<' {
-		if checkCurrentBufferContainsString(luaStartBlockMarker) {
-			return readLuaBlockTokens()
+	delete(p.spannedLines, token)
+	if newLinesCount > spannedLinesCount {
+		if target.extraLinesCount == 0 {
+			p.warnAtToken(warningShiftedLines, token, "Output has %d more lines than the input it replaces, so output lines after it do not match input lines until later lua blocks or macro invocations make up for them", newLinesCount-spannedLinesCount)
 		}
+		target.extraLinesCount += newLinesCount - spannedLinesCount
+		return
 	}
-	if c == '(' || c == ')' || c == '*' || c == '+' || c == '|' || c == '-' || c == ',' || c == '.' || c == '^' || c == '\'' || c == '"' || c == '\\' || c == '/' || c == ':' || c == ';' || c == '#' || c == '&' || c == '=' || c == '<' || c == '>' || c == '?' || c == '!' || c == '%' || c == '$' {
-		skipChars(1)
-		return []*Token{{SPECIAL, string(c), currentLineNumber, currentFile}}
-	}
-	if unicode.IsPunct(c) {
-		return []*Token{readPunctToken()}
+	paddingCount := spannedLinesCount - newLinesCount
+	caughtUpCount := paddingCount
+	if caughtUpCount > target.extraLinesCount {
+		caughtUpCount = target.extraLinesCount
 	}
-	if unicode.IsLetter(c) {
-		return []*Token{readSymbolToken()}
+	target.extraLinesCount -= caughtUpCount
+	paddingCount -= caughtUpCount
+	if paddingCount > 0 {
+		p.writeText(target, strings.Repeat("\n", paddingCount), token.inputFile(), lineIndex, nil)
 	}
-
-	_lineNumber := currentLineNumber
-	getChar(true)
-	return []*Token{{UNKNOWN, string(c), _lineNumber, currentFile}}
 }
 
-func getChar(moveForward bool) (rune, bool) {
-	if !charsStack.isEmpty() {
-		if moveForward {
-			return charsStack.pop(), true
-		} else {
-			return charsStack.peek(), true
+// writeText writes text that comes from the line of the file. Source text moves to the next line after every new line,
+// generated text stays on the line of the macro invocation or lua block that produced it.
+// Line information is written only at the start of output lines, where the line expected by the reader of the output differs from the real one
+func (p *Processor) writeText(target *OutputTarget, text string, filePath string, lineIndex int, producer *Producer) {
+	for text != "" {
+		lineEnd := strings.IndexByte(text, '\n') + 1
+		if lineEnd == 0 {
+			lineEnd = len(text)
 		}
-	}
-
-	if eof() {
-		return -1, false
-	}
-
-	result := rune(content[currentPosition])
-	if moveForward {
-		currentPosition++
-		if result == '\n' {
-			currentLineNumber++
+		line := text[:lineEnd]
+		//empty lines do not need line information
+		if target.atLineStart && strings.TrimRight(line, "\r\n") != "" && (target.expectedLineIndex != lineIndex || target.expectedFile != filePath) {
+			p.writeLineInformation(lineIndex, filePath, target)
+			target.expectedLineIndex = lineIndex
+			target.expectedFile = filePath
 		}
-	}
-	return result, true
-}
 
-func unGetChar(character rune) {
-	charsStack.push(character)
-	if character == '\n' {
-		currentLineNumber--
+		target.write(line, filePath, lineIndex, producer)
+		target.atLineStart = strings.HasSuffix(line, "\n")
+		if target.atLineStart {
+			target.expectedLineIndex++
+			if producer == nil {
+				lineIndex++
+			}
+		}
+		text = text[lineEnd:]
 	}
 }
 
-func executeTokens(tokens *list.List, luaState *lua.LState) {
-	for e := tokens.Front(); e != nil; e = e.Next() {
-		token := e.Value.(*Token)
+func (p *Processor) executeTokens(tokens *TokenList) {
+	for i := tokens.first(); i != noToken; i = tokens.next(i) {
+		token := tokens.get(i)
+		token.output = p.currentOutput
+		p.executedTokens, p.executedTokenIndex = tokens, i
+		p.producerOutput = p.currentOutput
 		if token.tokenType == LuaBlock {
-			executeLuaBlock(e, token, luaState)
+			p.currentProducer = p.newProducer("luaBlock", "", token)
+			startTime := p.beginTrace()
+			p.executeLuaBlock(i, tokens, token)
+			p.trace(token, nil, nil, startTime)
+		} else if token.tokenType == ESCAPE {
+			if nextIndex := tokens.next(i); nextIndex != noToken && p.isMacroToken(tokens.get(nextIndex)) {
+				//escaped macro name is written as plain text without the escape character
+				tokens.remove(i)
+				i = nextIndex
+				tokens.get(i).output = p.currentOutput
+			}
 		} else if token.tokenType == SYMBOL {
-			macro, exists := macroMap[token.value]
+			macro, exists := p.macroMap[token.text()]
 			if exists {
-				executeMacro(e, tokens, token, luaState, &macro)
+				p.currentProducer = p.newProducer("macro", macro.name, token)
+				p.usedMacros[macro.name] = true
+				startTime := p.beginTrace()
+				arguments := p.executeMacro(i, tokens, token, &macro)
+				p.trace(token, &macro, arguments, startTime)
 			}
 		}
+		p.currentProducer = nil
+		if streamMode && len(p.openBlocks) == 0 {
+			p.writeTokens(tokens, i)
+		}
+	}
+}
+
+// countRemovedLines counts new lines in the arguments of macro invocation, which were removed from the token list
+func countRemovedLines(tokenNode int, tokens *TokenList) int {
+	linesCount := 0
+	for i := tokenNode + 1; i < tokens.len() && tokens.get(i).removed; i++ {
+		linesCount += strings.Count(tokens.get(i).sourceText(), "\n")
+	}
+	return linesCount
+}
+
+func (p *Processor) isMacroToken(token *Token) bool {
+	if token.tokenType != SYMBOL {
+		return false
 	}
+	_, exists := p.macroMap[token.text()]
+	return exists
 }
 
-func executeMacro(tokenNode *list.Element, tokens *list.List, token *Token, luaState *lua.LState, macroStruct *MacroStruct) {
-	arguments := matchArguments(tokenNode.Next(), tokens, macroStruct)
-	token.value = ""
+// executeMacro calls the macro callback with arguments of the invocation and returns the arguments
+func (p *Processor) executeMacro(tokenNode int, tokens *TokenList, token *Token, macroStruct *MacroStruct) []interface{} {
+	luaState := p.luaState
+	arguments := matchArguments(tokens.next(tokenNode), tokens, token, macroStruct)
+	if preserveLines {
+		p.spannedLines[token] = countRemovedLines(tokenNode, tokens)
+	}
+	token.replaceText()
 	luaState.SetGlobal("currentBlock", createUserDataFromToken(token, luaState))
 	luaState.Push(macroStruct.callback)
 	for _, element := range arguments {
@@ -434,16 +514,18 @@ func executeMacro(tokenNode *list.Element, tokens *list.List, token *Token, luaS
 	}
 	defer func() {
 		if r := recover(); r != nil {
-			apiError := r.(*lua.ApiError)
-			token := tokenNode.Value.(*Token)
-			reportErrorAndExit(token, "Error while executing lua macro [%s]\n%s", macroStruct.name, apiError.Object)
+			apiError, ok := r.(*lua.ApiError)
+			if !ok {
+				panic(r)
+			}
+			reportError(token, "Error while executing lua macro [%s]\n%s", macroStruct.name, p.describeLuaError(apiError))
 		}
 	}()
 	luaState.Call(len(arguments), 0)
+	return arguments
 }
 
-func matchArguments(tokenNode *list.Element, tokens *list.List, macroStruct *MacroStruct) []interface{} {
-	initToken := tokenNode
+func matchArguments(tokenNode int, tokens *TokenList, macroToken *Token, macroStruct *MacroStruct) []interface{} {
 	argsCount := len(macroStruct.arguments)
 	var resultList []interface{}
 	if argsCount == 0 {
@@ -451,71 +533,64 @@ func matchArguments(tokenNode *list.Element, tokens *list.List, macroStruct *Mac
 		//macro
 		//or
 		//macro()
-		if getTokenNodeText(tokenNode) == "(" {
-			skipWhitespaces(tokenNode.Next(), tokens)
-			if getTokenNodeText(tokenNode.Next()) != ")" {
-				reportErrorAndExit(tokenNode.Value.(*Token), "Expected ')' to finish 0 argument list, but found [%s] while processing macro [%s]", escapeStringForDebugPrint(getTokenNodeText(tokenNode.Next())), macroStruct.name)
+		if getTokenNodeText(tokens, tokenNode) == "(" {
+			skipWhitespaces(tokens.next(tokenNode), tokens)
+			if getTokenNodeText(tokens, tokens.next(tokenNode)) != ")" {
+				reportError(getNodeToken(tokens, tokenNode, macroToken), "Expected ')' to finish 0 argument list, but found [%s] while processing macro [%s]", escapeStringForDebugPrint(getTokenNodeText(tokens, tokens.next(tokenNode))), macroStruct.name)
 			}
 
-			tokens.Remove(tokenNode.Next())
-			tokens.Remove(tokenNode)
+			tokens.remove(tokens.next(tokenNode))
+			tokens.remove(tokenNode)
 		}
 
 		return resultList
 	}
 
-	if getTokenNodeText(tokenNode) != "(" {
-		reportErrorAndExit(tokenNode.Value.(*Token), "Expected '(' to start argument list, but found [%s] while processing macro [%s]", escapeStringForDebugPrint(getTokenNodeText(tokenNode)), macroStruct.name)
+	if getTokenNodeText(tokens, tokenNode) != "(" {
+		reportError(getNodeToken(tokens, tokenNode, macroToken), "Expected '(' to start argument list, but found [%s] while processing macro [%s]", escapeStringForDebugPrint(getTokenNodeText(tokens, tokenNode)), macroStruct.name)
 	}
 
 	tokenNode = removeNode(tokenNode, tokens)
-	debugPrint(tokens, tokenNode)
 	tokenNode = skipWhitespaces(tokenNode, tokens)
-	debugPrint(tokens, tokenNode)
 	for i := 0; i < argsCount; i++ {
 		argType := macroStruct.arguments[i]
 		lastArgument := i == argsCount-1
 		if !macroStruct.variadic {
 			if argType == "raw" {
 				stringValue, _tokenNode := readNodesCollectTextUntilText(tokenNode, tokens, []string{",", ")"})
-				debugPrint(tokens, tokenNode)
 				tokenNode = _tokenNode
 				stringValue = strings.Trim(stringValue, " \t\n\r")
 				resultList = append(resultList, stringValue)
 			}
 
 			if !lastArgument {
-				if getTokenNodeText(tokenNode) != "," {
-					reportErrorAndExit(tokenNode.Value.(*Token), "Expected ',' but found [%s] while processing arguments of macro [%s]", escapeStringForDebugPrint(getTokenNodeText(tokenNode)), macroStruct.name)
+				if getTokenNodeText(tokens, tokenNode) != "," {
+					reportError(getNodeToken(tokens, tokenNode, macroToken), "Expected ',' but found [%s] while processing arguments of macro [%s]", escapeStringForDebugPrint(getTokenNodeText(tokens, tokenNode)), macroStruct.name)
 				}
 				tokenNode = removeNode(tokenNode, tokens)
-				debugPrint(tokens, tokenNode)
 			}
 		} else {
 			if !lastArgument {
 				if argType == "raw" {
 					stringValue, _tokenNode := readNodesCollectTextUntilText(tokenNode, tokens, []string{",", ")"})
-					debugPrint(tokens, tokenNode)
 					tokenNode = _tokenNode
 					stringValue = strings.Trim(stringValue, " \t\n\r")
 					resultList = append(resultList, stringValue)
 				}
 
-				if getTokenNodeText(tokenNode) != "," {
-					reportErrorAndExit(tokenNode.Value.(*Token), "Expected ',' but found [%s]", escapeStringForDebugPrint(getTokenNodeText(tokenNode)))
+				if getTokenNodeText(tokens, tokenNode) != "," {
+					reportError(getNodeToken(tokens, tokenNode, macroToken), "Expected ',' but found [%s]", escapeStringForDebugPrint(getTokenNodeText(tokens, tokenNode)))
 				}
 				tokenNode = removeNode(tokenNode, tokens)
-				debugPrint(tokens, tokenNode)
 			} else {
 				var stringsArray []string
 				for true {
 					stringValue, _tokenNode := readNodesCollectTextUntilText(tokenNode, tokens, []string{",", ")"})
-					debugPrint(tokens, tokenNode)
 					tokenNode = _tokenNode
 					stringValue = strings.Trim(stringValue, " \t\n\r")
 					stringsArray = append(stringsArray, stringValue)
 
-					nextTokenString := getTokenNodeText(tokenNode)
+					nextTokenString := getTokenNodeText(tokens, tokenNode)
 
 					if nextTokenString == ")" {
 						resultList = append(resultList, stringsArray)
@@ -524,38 +599,37 @@ func matchArguments(tokenNode *list.Element, tokens *list.List, macroStruct *Mac
 						tokenNode = removeNode(tokenNode, tokens)
 						continue
 					} else {
-						reportErrorAndExit(tokenNode.Value.(*Token), "Cannot parse variadic argument list in macro [%s]. Expected [,] or [)] but found [%s]", macroStruct.name, escapeStringForDebugPrint(nextTokenString))
+						reportError(getNodeToken(tokens, tokenNode, macroToken), "Cannot parse variadic argument list in macro [%s]. Expected [,] or [)] but found [%s]", macroStruct.name, escapeStringForDebugPrint(nextTokenString))
 					}
 				}
 			}
 		}
 	}
 
-	if tokenNode == nil {
-		reportErrorAndExit(initToken.Value.(*Token), "Syntax error while calling macro [%s]", macroStruct.name)
+	if tokenNode == noToken {
+		reportError(macroToken, "Syntax error while calling macro [%s]", macroStruct.name)
 		return nil
 	}
 
-	if getTokenNodeText(tokenNode) != ")" {
-		reportErrorAndExit(tokenNode.Value.(*Token), "Expected ')' to finish argument list, but found [%s]", escapeStringForDebugPrint(getTokenNodeText(tokenNode)))
+	if getTokenNodeText(tokens, tokenNode) != ")" {
+		reportError(getNodeToken(tokens, tokenNode, macroToken), "Expected ')' to finish argument list, but found [%s]", escapeStringForDebugPrint(getTokenNodeText(tokens, tokenNode)))
 	}
 
 	tokenNode = removeNode(tokenNode, tokens)
-	debugPrint(tokens, tokenNode)
 	return resultList
 }
 
-func readNodesCollectTextUntilText(tokenNode *list.Element, tokens *list.List, until []string) (string, *list.Element) {
-	var result string
-	for tokenNode != nil && !tokenEqualString(tokenNode, until) {
-		result = result + getTokenNodeText(tokenNode)
+func readNodesCollectTextUntilText(tokenNode int, tokens *TokenList, until []string) (string, int) {
+	var result strings.Builder
+	for tokenNode != noToken && !tokenEqualString(tokens, tokenNode, until) {
+		result.WriteString(getTokenNodeText(tokens, tokenNode))
 		tokenNode = removeNode(tokenNode, tokens)
 	}
-	return result, tokenNode
+	return result.String(), tokenNode
 }
 
-func tokenEqualString(tokenNode *list.Element, until []string) bool {
-	tokenString := getTokenNodeText(tokenNode)
+func tokenEqualString(tokens *TokenList, tokenNode int, until []string) bool {
+	tokenString := getTokenNodeText(tokens, tokenNode)
 	for i := 0; i < len(until); i++ {
 		if tokenString == until[i] {
 			return true
@@ -564,167 +638,266 @@ func tokenEqualString(tokenNode *list.Element, until []string) bool {
 	return false
 }
 
-func skipWhitespaces(tokenNode *list.Element, tokens *list.List) *list.Element {
-	for tokenNode.Value.(*Token).tokenType == WHITESPACE {
+func skipWhitespaces(tokenNode int, tokens *TokenList) int {
+	for tokenNode != noToken && tokens.get(tokenNode).tokenType == WHITESPACE {
 		tokenNode = removeNode(tokenNode, tokens)
-		if tokenNode == nil {
-			return tokenNode
-		}
 	}
 	return tokenNode
 }
 
-func removeNode(tokenNode *list.Element, tokens *list.List) *list.Element {
-	nextNode := tokenNode.Next()
-	tokens.Remove(tokenNode)
+func removeNode(tokenNode int, tokens *TokenList) int {
+	nextNode := tokens.next(tokenNode)
+	tokens.remove(tokenNode)
 	return nextNode
 }
 
-func getTokenNodeText(tokenNode *list.Element) string {
-	return tokenNode.Value.(*Token).value
+func getTokenNodeText(tokens *TokenList, tokenNode int) string {
+	if tokenNode == noToken {
+		return ""
+	}
+	return tokens.get(tokenNode).text()
 }
 
-func executeLuaBlock(tokenNode *list.Element, token *Token, luaState *lua.LState) {
-	luaState.SetGlobal("currentBlock", createUserDataFromToken(tokenNode.Next().Value.(*Token), luaState))
-	if err := luaState.DoString(token.value); err != nil {
-		apiError := err.(*lua.ApiError)
-		reportErrorAndExit(token, "Error while execution lua block\n%s", apiError.Object)
+// getNodeToken returns token of the node, or defaultToken if the end of file was reached
+func getNodeToken(tokens *TokenList, tokenNode int, defaultToken *Token) *Token {
+	if tokenNode == noToken {
+		return defaultToken
 	}
+	return tokens.get(tokenNode)
 }
 
-func registerFunctions(luaState *lua.LState) {
-	luaState.SetGlobal("writeToBlock", luaState.NewFunction(WriteToBlock))
-	luaState.SetGlobal("markBlock", luaState.NewFunction(MarkBlock))
-	luaState.SetGlobal("getMarkedBlock", luaState.NewFunction(GetMarkedBlock))
-	luaState.SetGlobal("macro", luaState.NewFunction(RegisterMacro))
-	luaState.SetGlobal("echo", luaState.NewFunction(Echo))
-	luaState.SetGlobal("registerGenerateLineInfoCallback", luaState.NewFunction(RegisterGenerateLineInfoCallback))
+func (p *Processor) executeLuaBlock(tokenNode int, tokens *TokenList, token *Token) {
+	luaState := p.luaState
+	outputToken := tokens.get(tokens.next(tokenNode))
+	if preserveLines {
+		p.spannedLines[outputToken] = strings.Count(token.sourceText(), "\n")
+	}
+	luaState.SetGlobal("currentBlock", createUserDataFromToken(outputToken, luaState))
+	if err := p.runLuaChunk(token.text(), token.inputFile(), int(token.lineIndex)); err != nil {
+		reportError(token, "Error while execution lua block\n%s", p.describeLuaError(err))
+	}
+	if outputToken.overlay == nil || len(outputToken.overlay.chunks) == 0 {
+		p.warnAtToken(warningEmptyLuaBlock, token, "Lua block writes nothing")
+	}
 }
 
-func RegisterGenerateLineInfoCallback(L *lua.LState) int {
+func (p *Processor) registerFunctions() {
+	luaState := p.luaState
+	luaState.SetGlobal("writeToBlock", luaState.NewFunction(p.WriteToBlock))
+	luaState.SetGlobal("markBlock", luaState.NewFunction(p.MarkBlock))
+	luaState.SetGlobal("getMarkedBlock", luaState.NewFunction(p.GetMarkedBlock))
+	luaState.SetGlobal("closeBlock", luaState.NewFunction(p.CloseBlock))
+	luaState.SetGlobal("macro", luaState.NewFunction(p.RegisterMacro))
+	luaState.SetGlobal("echo", luaState.NewFunction(p.Echo))
+	luaState.SetGlobal("registerGenerateLineInfoCallback", luaState.NewFunction(p.RegisterGenerateLineInfoCallback))
+	luaState.SetGlobal("beginOutput", luaState.NewFunction(p.BeginOutput))
+	luaState.SetGlobal("endOutput", luaState.NewFunction(p.EndOutput))
+	luaState.SetGlobal("addDependency", luaState.NewFunction(p.AddDependency))
+	p.trackLuaFileFunction("dofile")
+	p.trackLuaFileFunction("loadfile")
+	p.trackRequiredFiles()
+}
+
+func (p *Processor) RegisterGenerateLineInfoCallback(L *lua.LState) int {
 	L.CheckFunction(1)
-	generateLineInfoCallback = L.ToFunction(1)
+	p.generateLineInfoCallback = L.ToFunction(1)
 	return 0
 }
 
-func RegisterMacro(L *lua.LState) int {
+func (p *Processor) RegisterMacro(L *lua.LState) int {
 	L.CheckString(1)
 	macroName := L.ToString(1)
 	L.CheckTable(2)
 	L.CheckFunction(3)
-	_, macroExists := macroMap[macroName]
+	_, macroExists := p.macroMap[macroName]
 	if macroExists {
-		reportErrorAndExit(nil, "Macros with name [%s] already exists", macroName)
+		reportError(nil, "Macros with name [%s] already exists", macroName)
 	}
 
 	argumentsTable := L.ToTable(2)
+	var argumentTypes []string
+	for i := 1; i <= argumentsTable.Len(); i++ {
+		argumentTypes = append(argumentTypes, argumentsTable.RawGetInt(i).String())
+	}
+
+	macro := newMacro(macroName, argumentTypes)
+	macro.callback = L.ToFunction(3)
+	macro.definitionFile, macro.definitionLine = luaCallerLocation(L)
+	p.macroMap[macroName] = macro
+	return 0
+}
+
+// newMacro creates macro without callback and checks argument types. Only the last argument can be variadic
+func newMacro(macroName string, argumentTypes []string) MacroStruct {
 	var argumentsList []string
 	variadicArgsFunction := false
-	for i := 1; i <= argumentsTable.Len(); i++ {
-		isLastArgument := i == argumentsTable.Len()
+	for i, argumentType := range argumentTypes {
+		isLastArgument := i == len(argumentTypes)-1
 
-		argumentType := argumentsTable.RawGetInt(i).String()
 		varargs := false
 		if strings.HasSuffix(argumentType, "*") {
 			varargs = true
 			argumentType = argumentType[:len(argumentType)-1]
 		}
 		if varargs && !isLastArgument {
-			reportErrorAndExit(nil, "Error while register macro [%s]. Argument %d marked as variadic, but it is not last argument", macroName, i)
+			reportError(nil, "Error while register macro [%s]. Argument %d marked as variadic, but it is not last argument", macroName, i+1)
 		}
 
 		if argumentType == "raw" {
 			argumentsList = append(argumentsList, argumentType)
 		} else {
-			reportErrorAndExit(nil, "Error while register macro [%s]. Argument %d type should be [raw] but found [%s]", macroName, i, escapeStringForDebugPrint(argumentType))
+			reportError(nil, "Error while register macro [%s]. Argument %d type should be [raw] but found [%s]", macroName, i+1, escapeStringForDebugPrint(argumentType))
 		}
 		if varargs {
 			variadicArgsFunction = varargs
 		}
 	}
 
-	callback := L.ToFunction(3)
-
 	var macro MacroStruct
 	macro.name = macroName
 	macro.arguments = argumentsList
-	macro.callback = callback
 	macro.variadic = variadicArgsFunction
-	macroMap[macroName] = macro
-	return 0
+	return macro
 }
 
-func MarkBlock(L *lua.LState) int {
+func (p *Processor) MarkBlock(L *lua.LState) int {
 	L.CheckString(1)
 	L.CheckUserData(2)
 
 	name := L.ToString(1)
 	block := L.ToUserData(2)
 
-	_, exists := markedBlocks[name]
+	_, exists := p.markedBlocks[name]
 	if exists {
-		reportErrorAndExit(nil, "Marked block with name [%s] already exists", name)
+		reportError(nil, "Marked block with name [%s] already exists", name)
+	}
+	token := p.blockToken(block)
+	if token.written {
+		reportError(token, "Cannot mark block [%s], because it was already written to the output", name)
+	}
+	p.markedBlocks[name] = token
+	if streamMode {
+		p.openBlocks[name] = true
+	}
+	return 0
+}
+
+// CloseBlock tells that the marked block will not receive more text, so streaming mode can write it to the output
+func (p *Processor) CloseBlock(L *lua.LState) int {
+	L.CheckString(1)
+	name := L.ToString(1)
+	if _, exists := p.markedBlocks[name]; !exists {
+		reportError(nil, "Marked block with name [%s] does not exists", name)
 	}
-	markedBlocks[name] = block.Value.(*Token)
+	delete(p.openBlocks, name)
 	return 0
 }
 
-func GetMarkedBlock(L *lua.LState) int {
+// MissingBlock is returned by getMarkedBlock for the block that is not marked yet. It refers to the block by name,
+// so it can be written to after the block is marked, and fails only when it is used while the block is still not marked
+type MissingBlock struct {
+	name string
+}
+
+// GetMarkedBlock returns the marked block, or a placeholder when the block is not marked yet. Marking the block
+// after getMarkedBlock is reported as late-mark warning
+func (p *Processor) GetMarkedBlock(L *lua.LState) int {
 	L.CheckString(1)
 	name := L.ToString(1)
-	token, exists := markedBlocks[name]
+	token, exists := p.markedBlocks[name]
 	if !exists {
-		reportErrorAndExit(nil, "Marked block with name [%s] does not exists", name)
+		if _, missed := p.missedBlockLookups[name]; !missed {
+			file, line := luaCallerLocation(L)
+			p.missedBlockLookups[name] = SourceLocation{file, line}
+		}
+		userData := L.NewUserData()
+		userData.Value = &MissingBlock{name}
+		L.Push(userData)
+		return 1
 	}
 	L.Push(createUserDataFromToken(token, L))
 	return 1
 }
 
-func Echo(L *lua.LState) int {
+// blockToken returns the token of the block reference. Placeholders returned by getMarkedBlock are resolved by the block name
+func (p *Processor) blockToken(userData *lua.LUserData) *Token {
+	missingBlock, isMissing := userData.Value.(*MissingBlock)
+	if !isMissing {
+		return userData.Value.(*Token)
+	}
+	if token, exists := p.markedBlocks[missingBlock.name]; exists {
+		return token
+	}
+	lookup := p.missedBlockLookups[missingBlock.name]
+	if location, found := p.findLaterMark(missingBlock.name); found {
+		reportError(nil, "Marked block with name [%s] does not exists, getMarkedBlock was called for it at %s:%d\nIt is marked later at %s:%d, blocks should be marked before they are written to",
+			missingBlock.name, lookup.file, lookup.line, location.file, location.line)
+	}
+	reportError(nil, "Marked block with name [%s] does not exists, getMarkedBlock was called for it at %s:%d", missingBlock.name, lookup.file, lookup.line)
+	return nil
+}
+
+// findLaterMark searches lua blocks after the executed token for markBlock call with the block name.
+// Blocks marked by macros or by lua code that builds the name are not found
+func (p *Processor) findLaterMark(name string) (SourceLocation, bool) {
+	if p.executedTokens == nil {
+		return SourceLocation{}, false
+	}
+	markCall := regexp.MustCompile(`markBlock\s*\(\s*["']` + regexp.QuoteMeta(name) + `["']`)
+	tokens := p.executedTokens
+	for i := tokens.next(p.executedTokenIndex); i != noToken; i = tokens.next(i) {
+		token := tokens.get(i)
+		if token.tokenType != LuaBlock {
+			continue
+		}
+		code := token.text()
+		if match := markCall.FindStringIndex(code); match != nil {
+			return SourceLocation{token.inputFile(), int(token.lineIndex) + strings.Count(code[:match[0]], "\n") + 1}, true
+		}
+	}
+	return SourceLocation{}, false
+}
+
+func (p *Processor) Echo(L *lua.LState) int {
 	L.CheckAny(1)
 	stringValue := L.ToString(1)
 	userData := L.GetGlobal("currentBlock")
-	token := userData.(*lua.LUserData).Value.(*Token)
-	token.value = token.value + stringValue
+	token := p.blockToken(userData.(*lua.LUserData))
+	p.writeToToken(token, stringValue)
 	return 0
 }
 
-func WriteToBlock(L *lua.LState) int {
+func (p *Processor) WriteToBlock(L *lua.LState) int {
 	L.CheckUserData(1)
 	L.CheckAny(2)
 	blockUserData := L.ToUserData(1)
 	stringValue := L.ToString(2)
-	token := blockUserData.Value.(*Token)
-	token.value = token.value + stringValue
+	token := p.blockToken(blockUserData)
+	p.writeToToken(token, stringValue)
 	return 0
 }
 
+func (p *Processor) writeToToken(token *Token, text string) {
+	if token.written {
+		reportError(token, "Cannot write to the block, because it was already written to the output. "+
+			"Streaming mode writes text as soon as there are no open marked blocks. Mark the block with markBlock, or run without --stream")
+	}
+	output := ""
+	if p.currentProducer != nil && p.currentOutput != p.producerOutput {
+		output = p.currentOutput
+	}
+	token.appendText(text, p.currentProducer, output)
+	if traceWriter != nil {
+		p.emittedText.WriteString(text)
+	}
+}
+
 func createUserDataFromToken(token *Token, luaState *lua.LState) *lua.LUserData {
 	userData := luaState.NewUserData()
 	userData.Value = token
 	return userData
 }
 
-func readLuaBlockTokens() []*Token {
-	var result []*Token
-
-	result = append(result, &Token{LUA_BLOCK_START, luaStartBlockMarker, currentLineNumber, currentFile})
-	skipChars(len(luaStartBlockMarker))
-
-	luaBlock := readTokenUntilString(LuaBlock, luaEndBlockMarker)
-	if luaBlock.tokenType == EOF || luaBlock.tokenType == UNKNOWN {
-		reportErrorAndExit(nil, "Read EOF while search lua block end marker ["+luaEndBlockMarker+"]. Found ["+luaBlock.value+"]")
-	}
-
-	result = append(result, luaBlock)
-
-	result = append(result, &Token{SYMBOL, "", currentLineNumber, currentFile}) //block where script will output the text
-	_lineNumber := currentLineNumber
-	skipChars(len(luaEndBlockMarker))
-	result = append(result, &Token{LUA_BLOCK_END, luaEndBlockMarker, _lineNumber, currentFile})
-	return result
-}
-
 func escapeStringForDebugPrint(str string) string {
 	str = strings.ReplaceAll(str, "\r", "\\r")
 	str = strings.ReplaceAll(str, "\n", "\\n")
@@ -733,11 +906,39 @@ func escapeStringForDebugPrint(str string) string {
 	return str
 }
 
-func reportErrorAndExit(token *Token, formatString string, args ...interface{}) {
+type ProcessingError struct {
+	message string
+	//token where the error happened and the message without location, for commands that show locations in their own format
+	token       *Token
+	description string
+}
+
+func (e *ProcessingError) Error() string {
+	return e.message
+}
+
+// reportError stops processing of the current run. The error is caught by runProcessing
+func reportError(token *Token, formatString string, args ...interface{}) {
+	var message strings.Builder
 	if token != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Error at %s:%d\n", token.inputFile, token.lineIndex+1)
+		message.WriteString(fmt.Sprintf("Error at %s:%d\n", token.inputFile(), token.lineIndex+1))
 	}
-	_, _ = fmt.Fprintf(os.Stderr, formatString, args...)
-	_, _ = fmt.Fprintln(os.Stderr)
-	os.Exit(1)
+	description := fmt.Sprintf(formatString, args...)
+	message.WriteString(description)
+	panic(&ProcessingError{message.String(), token, description})
+}
+
+// runProcessing executes the function and returns the error reported with reportError, if any
+func runProcessing(function func()) (err *ProcessingError) {
+	defer func() {
+		if r := recover(); r != nil {
+			processingError, ok := r.(*ProcessingError)
+			if !ok {
+				panic(r)
+			}
+			err = processingError
+		}
+	}()
+	function()
+	return nil
 }
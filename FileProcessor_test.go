@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestInput is an input file that is processed from memory
+type TestInput struct {
+	path    string
+	content string
+}
+
+// processTestInputs processes inputs as one job with console output and returns the output
+func processTestInputs(tb testing.TB, luaCode string, inputs ...TestInput) string {
+	tb.Helper()
+	return processTestJob(tb, luaCode, inputs...).outputs.targets[mainOutputName].buffer.String()
+}
+
+// processTestJob processes inputs as one job like processJob does and returns the closed processor.
+// Outputs are kept in memory, so the main output and diverted outputs can be checked together with warnings
+func processTestJob(tb testing.TB, luaCode string, inputs ...TestInput) *Processor {
+	tb.Helper()
+	processor, err := newProcessor(nil)
+	defer processor.close()
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+	if luaCode != "" {
+		if err := processor.runLuaChunk(luaCode, "test.lua", 0); err != nil {
+			tb.Fatal(processor.describeLuaError(err))
+		}
+		processor.librariesMacroMap = copyMacroMap(processor.macroMap)
+	}
+
+	err = runProcessing(func() {
+		processor.outputs = newOutputSet("console")
+		for _, input := range inputs {
+			tokens := newLexer(input.content, input.path).tokenize()
+			processor.resetOutputStack()
+			processor.executeTokens(tokens)
+			processor.writeTokens(tokens, noToken)
+		}
+		processor.checkJobWarnings()
+	})
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+	return processor
+}
+
+func processTestText(tb testing.TB, luaCode string, text string) string {
+	tb.Helper()
+	return processTestInputs(tb, luaCode, TestInput{"test.tpl", text})
+}
+
+// benchmarkSizes are sizes of generated templates. Time per line should stay the same for all sizes
+var benchmarkSizes = []int{10000, 100000, 1000000}
+
+// BenchmarkEchoLines writes many lines to one block with echo, which appends to the overlay of the token
+func BenchmarkEchoLines(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("lines=%d", size), func(b *testing.B) {
+			template := fmt.Sprintf("<?lua for i = 1, %d do echo(\"line \" .. i .. \"\\n\") end lua?>", size)
+			for i := 0; i < b.N; i++ {
+				processTestText(b, "", template)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*size), "ns/line")
+		})
+	}
+}
+
+// BenchmarkVariadicMacro invokes the macro with many arguments, which are collected by readNodesCollectTextUntilText
+func BenchmarkVariadicMacro(b *testing.B) {
+	const macroCode = `macro("PRINT_LIST", {"raw*"}, function(items) for _, item in ipairs(items) do echo(item .. "\n") end end)`
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("arguments=%d", size), func(b *testing.B) {
+			var template strings.Builder
+			template.WriteString("PRINT_LIST(")
+			for i := 0; i < size; i++ {
+				if i != 0 {
+					template.WriteString(", ")
+				}
+				_, _ = fmt.Fprintf(&template, "item%d", i)
+			}
+			template.WriteString(")\n")
+			for i := 0; i < b.N; i++ {
+				processTestText(b, macroCode, template.String())
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*size), "ns/argument")
+		})
+	}
+}
+
+func TestVariadicMacroOutput(t *testing.T) {
+	output := processTestText(t, `macro("PRINT_LIST", {"raw", "raw*"}, function(name, items) echo(name .. ":" .. table.concat(items, "|")) end)`,
+		"PRINT_LIST(list, a, b c, d)\n")
+	if output != "list:a|b c|d\n" {
+		t.Errorf("Unexpected output [%s]", escapeStringForDebugPrint(output))
+	}
+}
+
+func TestPreserveLinesCatchesUpAfterExtraLines(t *testing.T) {
+	preserveLines = true
+	defer func() { preserveLines = false }()
+	output := processTestText(t, `macro("TWO", {}, function() echo("x\ny\n") end)`, "a\nTWO()\nb\n<?lua\n\n\n\nlua?>\nc\n")
+	//c stays on line 9, because the lua block gets 2 new lines less
+	expected := "a\nx\ny\n\nb\n\n\n\nc\n"
+	if output != expected {
+		t.Errorf("Expected [%s] but found [%s]", escapeStringForDebugPrint(expected), escapeStringForDebugPrint(output))
+	}
+}
+
+func TestOutputDivertedInsideMacro(t *testing.T) {
+	outputs := processTestJob(t, `macro("HDR", {"raw"}, function(name) beginOutput("gen.inc") echo("#define " .. name .. "\n") endOutput() echo("uses " .. name) end)`,
+		TestInput{"test.tpl", "a\nHDR(FOO)\n<?lua beginOutput(\"gen.inc\") echo(\"x\\n\") lua?>b\n<?lua endOutput() lua?>c\n"}).outputs
+	if output := outputs.targets[mainOutputName].buffer.String(); output != "a\nuses FOO\nc\n" {
+		t.Errorf("Unexpected main output [%s]", escapeStringForDebugPrint(output))
+	}
+	if output := outputs.target("gen.inc").buffer.String(); output != "#define FOO\nx\nb\n" {
+		t.Errorf("Unexpected diverted output [%s]", escapeStringForDebugPrint(output))
+	}
+}
+
+func TestGetMarkedBlockBeforeMark(t *testing.T) {
+	processor := processTestJob(t, "", TestInput{"test.tpl", "a <?lua b = getMarkedBlock(\"B\") lua?>\n<?lua markBlock(\"B\", currentBlock) lua?>\n<?lua writeToBlock(b, \"x\") lua?>\n"})
+	if output := processor.outputs.targets[mainOutputName].buffer.String(); output != "a \nx\n\n" {
+		t.Errorf("Unexpected output [%s]", escapeStringForDebugPrint(output))
+	}
+	if len(processor.warnings) != 1 || processor.warnings[0].category != warningLateMark || processor.warnings[0].line != 1 {
+		t.Errorf("Expected late-mark warning at line 1, but found %v", processor.warnings)
+	}
+}
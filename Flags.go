@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CommandLineFlag describes a command line flag. Flags without value name are switches
+type CommandLineFlag struct {
+	shortName   string
+	longName    string
+	valueName   string
+	description string
+	apply       func(value string)
+}
+
+// Command is a subcommand of luatp with its own flags. Help of the command is generated from the flag definitions
+type Command struct {
+	name        string
+	arguments   string
+	description string
+	flags       []*CommandLineFlag
+	//run receives arguments that are not flags
+	run func(arguments []string)
+}
+
+const defaultCommandName = "run"
+
+var commands []*Command
+
+func findCommand(name string) *Command {
+	for _, command := range commands {
+		if command.name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+// parseCommandLine selects the command by the first argument and applies its flags. Without command name the default command is used.
+// Returns the command and arguments that are not flags
+func parseCommandLine(args []string) (*Command, []string) {
+	command := findCommand(defaultCommandName)
+	if len(args) > 0 {
+		if namedCommand := findCommand(args[0]); namedCommand != nil {
+			command = namedCommand
+			args = args[1:]
+		}
+	}
+	return command, command.parseFlags(args)
+}
+
+// parseFlags applies flags and returns other arguments. Everything after "--" is not a flag
+func (c *Command) parseFlags(args []string) []string {
+	var arguments []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			arguments = append(arguments, args[i+1:]...)
+			break
+		}
+		if strings.HasPrefix(arg, "--") {
+			i = c.parseLongFlag(args, i)
+		} else if strings.HasPrefix(arg, "-") && arg != stdinPath {
+			i = c.parseShortFlags(args, i)
+		} else {
+			arguments = append(arguments, arg)
+		}
+	}
+	return arguments
+}
+
+// parseLongFlag parses "--name value" and "--name=value". Returns index of the last used argument
+func (c *Command) parseLongFlag(args []string, argIndex int) int {
+	name := args[argIndex][2:]
+	value := ""
+	valueProvided := false
+	if separatorIndex := strings.Index(name, "="); separatorIndex != -1 {
+		name, value, valueProvided = name[:separatorIndex], name[separatorIndex+1:], true
+	}
+
+	flag := c.findFlag(func(flag *CommandLineFlag) bool { return flag.longName == name })
+	if flag == nil {
+		c.failUnknownFlag("--" + name)
+	}
+	if flag.valueName == "" {
+		if valueProvided {
+			fail("Flag --"+name, "does not accept a value")
+		}
+		flag.apply("")
+		return argIndex
+	}
+	if !valueProvided {
+		argIndex = c.nextValue(args, argIndex, flag, "--"+name)
+		value = args[argIndex]
+	}
+	flag.apply(value)
+	return argIndex
+}
+
+// parseShortFlags parses "-o value", value attached to the flag "-ovalue" and combined switches "-vh".
+// Short names can have several letters, like -MD, so the longest matching name is used
+func (c *Command) parseShortFlags(args []string, argIndex int) int {
+	rest := args[argIndex][1:]
+	for rest != "" {
+		var flag *CommandLineFlag
+		for _, candidate := range c.allFlags() {
+			if candidate.shortName != "" && strings.HasPrefix(rest, candidate.shortName) && (flag == nil || len(candidate.shortName) > len(flag.shortName)) {
+				flag = candidate
+			}
+		}
+		if flag == nil {
+			c.failUnknownFlag("-" + rest)
+		}
+		rest = rest[len(flag.shortName):]
+		if flag.valueName == "" {
+			flag.apply("")
+			continue
+		}
+		if rest == "" {
+			argIndex = c.nextValue(args, argIndex, flag, "-"+flag.shortName)
+			rest = args[argIndex]
+		}
+		flag.apply(rest)
+		break
+	}
+	return argIndex
+}
+
+func (c *Command) nextValue(args []string, argIndex int, flag *CommandLineFlag, flagName string) int {
+	argIndex++
+	if argIndex >= len(args) {
+		fail("You should provide", flag.valueName, "after", flagName)
+	}
+	return argIndex
+}
+
+func (c *Command) failUnknownFlag(name string) {
+	fail("Unknown flag", name, "for command", c.name+". Run 'luatp help "+c.name+"' to see available flags")
+}
+
+func (c *Command) findFlag(predicate func(flag *CommandLineFlag) bool) *CommandLineFlag {
+	for _, flag := range c.allFlags() {
+		if predicate(flag) {
+			return flag
+		}
+	}
+	return nil
+}
+
+// allFlags returns flags of the command and flags that every command has
+func (c *Command) allFlags() []*CommandLineFlag {
+	return append(append([]*CommandLineFlag{}, c.flags...),
+		&CommandLineFlag{"h", "help", "", "show help", func(string) {
+			if c.name == defaultCommandName {
+				printMainHelp()
+			} else {
+				c.printHelp()
+			}
+			os.Exit(0)
+		}},
+		&CommandLineFlag{"v", "version", "", "show version", func(string) {
+			printVersion()
+			os.Exit(0)
+		}},
+	)
+}
+
+// usage returns flag names with the value, for example "-o, --output FILE"
+func (flag *CommandLineFlag) usage() string {
+	var names []string
+	if flag.shortName != "" {
+		names = append(names, "-"+flag.shortName)
+	}
+	if flag.longName != "" {
+		names = append(names, "--"+flag.longName)
+	}
+	result := strings.Join(names, ", ")
+	if flag.valueName != "" {
+		result += " " + flag.valueName
+	}
+	return result
+}
+
+func (c *Command) printHelp() {
+	fmt.Println(strings.TrimSpace("Usage: luatp " + c.name + " [flags] " + c.arguments))
+	fmt.Println(c.description)
+	fmt.Println()
+	fmt.Println("Flags:")
+	printFlags(c.allFlags())
+}
+
+func printFlags(flags []*CommandLineFlag) {
+	width := 0
+	for _, flag := range flags {
+		if len(flag.usage()) > width {
+			width = len(flag.usage())
+		}
+	}
+	for _, flag := range flags {
+		lines := strings.Split(flag.description, "\n")
+		fmt.Printf("  %-*s  %s\n", width, flag.usage(), lines[0])
+		for _, line := range lines[1:] {
+			fmt.Printf("  %-*s  %s\n", width, "", line)
+		}
+	}
+}
+
+// printMainHelp prints the list of commands and help of the default command
+func printMainHelp() {
+	fmt.Println("luatp\nLua Text Preprocessor - tool that can preprocess text with lua scripts")
+	fmt.Println("Usage: luatp [command] [flags] [files]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	width := 0
+	for _, command := range commands {
+		if len(command.name) > width {
+			width = len(command.name)
+		}
+	}
+	for _, command := range commands {
+		fmt.Printf("  %-*s  %s\n", width, command.name, strings.Split(command.description, "\n")[0])
+	}
+	fmt.Println()
+	fmt.Println("Command '" + defaultCommandName + "' is used when command is not provided. Run 'luatp help COMMAND' to see flags of the command")
+	fmt.Println()
+	findCommand(defaultCommandName).printHelp()
+}
+
+// printCommandHelp is the 'help' command. Without command name it prints the main help
+func printCommandHelp(arguments []string) {
+	if len(arguments) == 0 {
+		printMainHelp()
+		return
+	}
+	command := findCommand(arguments[0])
+	if command == nil {
+		fail("Unknown command", arguments[0])
+	}
+	command.printHelp()
+}
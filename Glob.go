@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var includePatterns []string
+var excludePatterns []string
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// expandInputPaths replaces directories and glob patterns with the files they match.
+// Matches of each argument are sorted, so the processing order does not depend on the file system
+func expandInputPaths(inputPaths []string) []string {
+	var result []string
+	for _, inputPath := range inputPaths {
+		if inputPath == stdinPath {
+			result = append(result, inputPath)
+			continue
+		}
+
+		var matches []string
+		if isDirectory(inputPath) {
+			matches = findFiles(inputPath, "**")
+		} else if hasGlobMeta(inputPath) {
+			root, pattern := splitGlobPattern(inputPath)
+			matches = findFiles(root, pattern)
+		} else {
+			result = append(result, inputPath)
+			continue
+		}
+
+		if len(matches) == 0 {
+			fail("No input files match", inputPath)
+		}
+		result = append(result, matches...)
+	}
+	return result
+}
+
+// inputDirectories returns directories searched by input directories and glob patterns, including their subdirectories.
+// Adding or removing a file changes the modification time of its directory, so watch mode finds new inputs with them
+func inputDirectories(inputPaths []string) []string {
+	var result []string
+	for _, inputPath := range inputPaths {
+		root := inputPath
+		if hasGlobMeta(inputPath) {
+			root, _ = splitGlobPattern(inputPath)
+		} else if !isDirectory(inputPath) {
+			continue
+		}
+		_ = filepath.WalkDir(root, func(filePath string, entry fs.DirEntry, err error) error {
+			if err == nil && entry.IsDir() {
+				result = append(result, filePath)
+			}
+			return nil
+		})
+	}
+	return result
+}
+
+func isDirectory(filePath string) bool {
+	info, err := os.Stat(filePath)
+	return err == nil && info.IsDir()
+}
+
+// splitGlobPattern splits pattern to the directory without glob symbols, where the search starts, and the rest of the pattern
+func splitGlobPattern(pattern string) (string, string) {
+	parts := strings.Split(filepath.ToSlash(pattern), "/")
+	staticPartsCount := 0
+	for staticPartsCount < len(parts)-1 && !hasGlobMeta(parts[staticPartsCount]) {
+		staticPartsCount++
+	}
+
+	root := strings.Join(parts[:staticPartsCount], "/")
+	if root == "" && staticPartsCount > 0 {
+		root = "/"
+	} else if root == "" {
+		root = "."
+	}
+	return filepath.FromSlash(root), strings.Join(parts[staticPartsCount:], "/")
+}
+
+// findFiles returns sorted list of files inside root directory, which relative path matches the pattern and include/exclude filters
+func findFiles(root string, pattern string) []string {
+	var result []string
+	_ = filepath.WalkDir(root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return nil
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		if matchGlobPath(pattern, relativePath) && passesInputFilters(relativePath) {
+			result = append(result, filePath)
+		}
+		return nil
+	})
+	sort.Strings(result)
+	return result
+}
+
+// passesInputFilters checks --include and --exclude patterns. Patterns without '/' are matched against the file name only
+func passesInputFilters(relativePath string) bool {
+	if len(includePatterns) > 0 && !matchAnyFilter(includePatterns, relativePath) {
+		return false
+	}
+	return !matchAnyFilter(excludePatterns, relativePath)
+}
+
+func matchAnyFilter(patterns []string, relativePath string) bool {
+	for _, pattern := range patterns {
+		pattern = filepath.ToSlash(pattern)
+		if strings.Contains(pattern, "/") {
+			if matchGlobPath(pattern, relativePath) {
+				return true
+			}
+		} else if matched, _ := path.Match(pattern, path.Base(relativePath)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlobPath matches slash separated path against the pattern. '**' matches any number of directories
+func matchGlobPath(pattern string, filePath string) bool {
+	return matchGlobParts(strings.Split(pattern, "/"), strings.Split(filePath, "/"))
+}
+
+func matchGlobParts(patternParts []string, pathParts []string) bool {
+	if len(patternParts) == 0 {
+		return len(pathParts) == 0
+	}
+	if patternParts[0] == "**" {
+		for i := 0; i <= len(pathParts); i++ {
+			if matchGlobParts(patternParts[1:], pathParts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(pathParts) == 0 {
+		return false
+	}
+	matched, err := path.Match(patternParts[0], pathParts[0])
+	if err != nil {
+		fail("Wrong glob pattern", strings.Join(patternParts, "/"), err.Error())
+	}
+	return matched && matchGlobParts(patternParts[1:], pathParts[1:])
+}
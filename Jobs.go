@@ -0,0 +1,134 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+type ProcessingJob struct {
+	inputs     []string
+	outputPath string
+}
+
+// createProcessingJobs creates jobs for inputs. Inputs written to the output directory mirror their paths relative to baseDirectory
+func createProcessingJobs(inputs []string, outputs []string, outputDirectory string, outputExtensionRewrite string, baseDirectory string) []ProcessingJob {
+	if outputDirectory != "" {
+		if len(outputs) != 0 {
+			fail("Flags -o and --out-dir cannot be used together")
+		}
+		return createOutputDirectoryJobs(inputs, outputDirectory, outputExtensionRewrite, baseDirectory)
+	}
+
+	if len(outputs) > 1 {
+		if len(outputs) != len(inputs) {
+			fail("Number of -o flags", len(outputs), "does not match number of -f flags", len(inputs))
+		}
+		var jobs []ProcessingJob
+		for i, inputFilePath := range inputs {
+			jobs = append(jobs, ProcessingJob{[]string{inputFilePath}, outputs[i]})
+		}
+		return jobs
+	}
+
+	outputFilePath := "console"
+	if len(outputs) == 1 {
+		outputFilePath = outputs[0]
+	}
+	return []ProcessingJob{{inputs, outputFilePath}}
+}
+
+// checkOutputPaths fails when output file of a job is an input file, because the output is created before inputs are read,
+// or when several jobs write to the same file
+func checkOutputPaths(jobs []ProcessingJob) {
+	inputPaths := make(map[string]string)
+	for _, job := range jobs {
+		for _, inputFilePath := range job.inputs {
+			if inputFilePath != stdinPath {
+				inputPaths[absolutePath(inputFilePath)] = inputFilePath
+			}
+		}
+	}
+	outputJobs := make(map[string]int)
+	for i, job := range jobs {
+		if isConsolePath(job.outputPath) {
+			continue
+		}
+		outputPath := absolutePath(job.outputPath)
+		if inputFilePath, exists := inputPaths[outputPath]; exists {
+			fail("Output file", job.outputPath, "is the same as input file", inputFilePath)
+		}
+		if otherIndex, exists := outputJobs[outputPath]; exists {
+			fail("Inputs", strings.Join(jobs[otherIndex].inputs, ", "), "and", strings.Join(job.inputs, ", "), "are written to the same output file", job.outputPath)
+		}
+		outputJobs[outputPath] = i
+	}
+}
+
+// absolutePath returns absolute path of the file, or the path itself if it cannot be resolved
+func absolutePath(filePath string) string {
+	if absPath, err := filepath.Abs(filePath); err == nil {
+		return absPath
+	}
+	return filePath
+}
+
+// createOutputDirectoryJobs creates job for every input. Inputs that would be written to the same output file are rejected,
+// for example inputs with the same name outside of the base directory
+func createOutputDirectoryJobs(inputs []string, outputDirectory string, outputExtensionRewrite string, baseDirectory string) []ProcessingJob {
+	var jobs []ProcessingJob
+	outputInputs := make(map[string]string)
+	for _, inputFilePath := range inputs {
+		outputPath := filepath.Join(outputDirectory, rewriteOutputExtension(mirroredInputPath(inputDisplayName(inputFilePath), baseDirectory), outputExtensionRewrite))
+		if sameFilePath(inputFilePath, outputPath) {
+			fail("Output file for", inputFilePath, "is the same as input file. Use --out-ext to change the extension")
+		}
+		if otherInputFilePath, exists := outputInputs[outputPath]; exists {
+			//the same file can be found both in a directory and in a glob pattern
+			if sameFilePath(otherInputFilePath, inputFilePath) {
+				continue
+			}
+			fail("Inputs", otherInputFilePath, "and", inputFilePath, "are written to the same output file", outputPath)
+		}
+		outputInputs[outputPath] = inputFilePath
+		jobs = append(jobs, ProcessingJob{[]string{inputFilePath}, outputPath})
+	}
+	return jobs
+}
+
+// mirroredInputPath returns path of the input file relative to the base directory.
+// Inputs that are outside of the base directory keep only their file name
+func mirroredInputPath(inputFilePath string, baseDirectory string) string {
+	absBaseDirectory, err := filepath.Abs(baseDirectory)
+	if err != nil {
+		return filepath.Base(inputFilePath)
+	}
+	absInputFilePath, err := filepath.Abs(inputFilePath)
+	if err != nil {
+		return filepath.Base(inputFilePath)
+	}
+	relativePath, err := filepath.Rel(absBaseDirectory, absInputFilePath)
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return filepath.Base(inputFilePath)
+	}
+	return relativePath
+}
+
+// rewriteOutputExtension applies rewrite rule in form "FROM=TO" to the end of the file path.
+// Empty rule removes the last extension, so "foo.asm.tpl" becomes "foo.asm"
+func rewriteOutputExtension(filePath string, rule string) string {
+	if rule == "" {
+		return strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	}
+
+	from := rule
+	to := ""
+	separatorIndex := strings.Index(rule, "=")
+	if separatorIndex != -1 {
+		from = rule[:separatorIndex]
+		to = rule[separatorIndex+1:]
+	}
+	if !strings.HasSuffix(filePath, from) {
+		return filePath
+	}
+	return filePath[:len(filePath)-len(from)] + to
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// lua block delimiters, can be changed with --delimiters or in the project config
+var luaStartBlockMarker = "<?lua"
+var luaEndBlockMarker = "lua?>"
+
+// escapeCharacter before lua block start marker or before macro name makes them plain text. Empty string disables escaping.
+// Escaping is disabled by default, because it changes the output of templates that have the character before macro names
+var escapeCharacter = ""
+var escapeCharacterProvided = false
+
+// streamChunkSize is the number of bytes read from the input at once in streaming mode
+const streamChunkSize = 64 * 1024
+
+type includePredicate func(rune) bool
+
+// Lexer splits content of one input file to tokens
+type Lexer struct {
+	source            *SourceFile
+	content           string
+	currentPosition   int
+	currentLineNumber int
+	//start of the token being read. Streaming lexer keeps content from this position when it reads the next chunk
+	tokenStart int
+	tokens     *TokenList
+	//set in streaming mode until the end of the input is reached
+	reader *bufio.Reader
+}
+
+func newLexer(fileContent string, filePath string) *Lexer {
+	if len(fileContent) > math.MaxInt32 {
+		reportError(nil, "File %s is too big. Maximum supported size is %d bytes", filePath, math.MaxInt32)
+	}
+	return &Lexer{
+		source:  &SourceFile{filePath, fileContent},
+		content: fileContent,
+		tokens:  newTokenList(),
+	}
+}
+
+// newStreamLexer creates lexer that reads the input by chunks when the token list asks for more tokens.
+// Every chunk gets its own SourceFile, so chunks are released together with the tokens that were written to the output
+func newStreamLexer(reader io.Reader, filePath string) *Lexer {
+	lexer := &Lexer{
+		source: &SourceFile{filePath, ""},
+		tokens: newTokenList(),
+		reader: bufio.NewReaderSize(reader, streamChunkSize),
+	}
+	lexer.tokens.lexer = lexer
+	return lexer
+}
+
+func (l *Lexer) addToken(tokenType int8, lineIndex int) *Token {
+	return l.tokens.add(Token{tokenType: tokenType, start: int32(l.tokenStart), end: int32(l.currentPosition), lineIndex: int32(lineIndex), source: l.source})
+}
+
+// ensureAvailable reads chunks from the stream until count bytes after the current position are available or the input ends
+func (l *Lexer) ensureAvailable(count int) {
+	for l.reader != nil && len(l.content)-l.currentPosition < count {
+		chunk := make([]byte, streamChunkSize)
+		n, err := l.reader.Read(chunk)
+		if n > 0 {
+			l.appendContent(string(chunk[:n]))
+		}
+		if err == io.EOF {
+			l.reader = nil
+		} else if err != nil {
+			reportError(nil, "Cannot read file %s\n%s", l.source.path, err.Error())
+		}
+	}
+}
+
+// appendContent starts a new chunk that contains the unfinished token and the data read from the stream
+func (l *Lexer) appendContent(data string) {
+	keptContent := l.content[l.tokenStart:]
+	if len(keptContent)+len(data) > math.MaxInt32 {
+		reportError(nil, "Token in file %s is too big. Maximum supported size is %d bytes", l.source.path, math.MaxInt32)
+	}
+	l.content = keptContent + data
+	l.currentPosition -= l.tokenStart
+	l.tokenStart = 0
+	l.source = &SourceFile{l.source.path, l.content}
+}
+
+// tokenize reads all tokens of the file
+func (l *Lexer) tokenize() *TokenList {
+	for l.readNextToken() {
+	}
+	return l.tokens
+}
+
+func (l *Lexer) checkCurrentBufferContainsString(str string) bool {
+	l.ensureAvailable(len(str))
+	return strings.HasPrefix(l.content[l.currentPosition:], str)
+}
+
+// atMarkerStart checks whether lua block start marker or escape character begins at the current position
+func (l *Lexer) atMarkerStart() bool {
+	return l.checkCurrentBufferContainsString(luaStartBlockMarker) || (escapeCharacter != "" && l.checkCurrentBufferContainsString(escapeCharacter))
+}
+
+func (l *Lexer) eof() bool {
+	l.ensureAvailable(1)
+	return l.currentPosition >= len(l.content)
+}
+
+func (l *Lexer) skipChars(count int) {
+	for i := 0; i < count; i++ {
+		l.getChar(true)
+	}
+}
+
+// readTokenWhilePredicate reads characters that match the predicate. The token ends before lua block start marker and escape character,
+// because custom delimiters and escape characters can consist of punctuation or letters that match the predicate
+func (l *Lexer) readTokenWhilePredicate(tokenType int8, predicate includePredicate) {
+	lineNumber := l.currentLineNumber
+	for !l.eof() {
+		c, _ := l.getChar(false)
+		if !predicate(c) {
+			break
+		}
+		if l.currentPosition != l.tokenStart && l.atMarkerStart() {
+			break
+		}
+		l.getChar(true)
+	}
+
+	l.addToken(tokenType, lineNumber)
+}
+
+// skipUntilString moves to the beginning of untilString. Returns false if the end of file was reached
+func (l *Lexer) skipUntilString(untilString string) bool {
+	for !l.eof() {
+		if l.checkCurrentBufferContainsString(untilString) {
+			return true
+		}
+		l.getChar(true)
+	}
+	return false
+}
+
+func (l *Lexer) readWhitespaceToken() {
+	l.readTokenWhilePredicate(WHITESPACE, func(c rune) bool {
+		return unicode.IsSpace(c)
+	})
+}
+
+func (l *Lexer) readNumberToken() {
+	l.readTokenWhilePredicate(NUMBER, func(c rune) bool {
+		return unicode.IsNumber(c) || c == '.'
+	})
+}
+
+func (l *Lexer) readPunctToken() {
+	l.readTokenWhilePredicate(SPECIAL, func(c rune) bool {
+		return unicode.IsPunct(c)
+	})
+}
+
+func (l *Lexer) readSymbolToken() {
+	l.readTokenWhilePredicate(SYMBOL, func(c rune) bool {
+		return unicode.IsLetter(c) || unicode.IsNumber(c) || c == '_'
+	})
+}
+
+// readNextToken reads next token to the token list. Returns false when the end of file is reached
+func (l *Lexer) readNextToken() bool {
+	l.tokenStart = l.currentPosition
+	c, success := l.getChar(false)
+	if !success {
+		return false
+	}
+	if escapeCharacter != "" && l.checkCurrentBufferContainsString(escapeCharacter) && l.readEscapedToken() {
+		return true
+	}
+	if l.checkCurrentBufferContainsString(luaStartBlockMarker) {
+		l.readLuaBlockTokens()
+		return true
+	}
+	if unicode.IsSpace(c) {
+		l.readWhitespaceToken()
+		return true
+	}
+	if unicode.IsNumber(c) {
+		l.readNumberToken()
+		return true
+	}
+	if c == '(' || c == ')' || c == '*' || c == '+' || c == '|' || c == '-' || c == ',' || c == '.' || c == '^' || c == '\'' || c == '"' || c == '\\' || c == '/' || c == ':' || c == ';' || c == '#' || c == '&' || c == '=' || c == '<' || c == '>' || c == '?' || c == '!' || c == '%' || c == '$' {
+		l.skipChars(1)
+		l.addToken(SPECIAL, l.currentLineNumber)
+		return true
+	}
+	if unicode.IsPunct(c) {
+		l.readPunctToken()
+		return true
+	}
+	if unicode.IsLetter(c) {
+		l.readSymbolToken()
+		return true
+	}
+
+	_lineNumber := l.currentLineNumber
+	l.getChar(true)
+	l.addToken(UNKNOWN, _lineNumber)
+	return true
+}
+
+func (l *Lexer) getChar(moveForward bool) (rune, bool) {
+	if l.eof() {
+		return -1, false
+	}
+
+	l.ensureAvailable(utf8.UTFMax)
+	result, size := utf8.DecodeRuneInString(l.content[l.currentPosition:])
+	if moveForward {
+		l.currentPosition += size
+		if result == '\n' {
+			l.currentLineNumber++
+		}
+	}
+	return result, true
+}
+
+// readEscapedToken reads the escape character followed by lua block start marker or by a symbol. Escaped marker becomes
+// plain text without the escape character. Escape character before the symbol is kept as ESCAPE token, because it is dropped
+// only before macro names, and macros are known when tokens are executed. Returns false when nothing is escaped
+func (l *Lexer) readEscapedToken() bool {
+	l.ensureAvailable(len(escapeCharacter) + len(luaStartBlockMarker) + utf8.UTFMax)
+	escapedText := l.content[l.currentPosition+len(escapeCharacter):]
+	if strings.HasPrefix(escapedText, luaStartBlockMarker) {
+		l.skipChars(utf8.RuneCountInString(escapeCharacter))
+		l.tokenStart = l.currentPosition
+		l.skipChars(utf8.RuneCountInString(luaStartBlockMarker))
+		l.addToken(SPECIAL, l.currentLineNumber)
+		return true
+	}
+	if c, _ := utf8.DecodeRuneInString(escapedText); unicode.IsLetter(c) {
+		l.skipChars(utf8.RuneCountInString(escapeCharacter))
+		l.addToken(ESCAPE, l.currentLineNumber)
+		return true
+	}
+	return false
+}
+
+func (l *Lexer) readLuaBlockTokens() {
+	l.skipChars(utf8.RuneCountInString(luaStartBlockMarker))
+	startToken := l.addToken(LUA_BLOCK_START, l.currentLineNumber)
+
+	l.tokenStart = l.currentPosition
+	lineNumber := l.currentLineNumber
+	if !l.skipUntilString(luaEndBlockMarker) {
+		reportError(startToken, "Read EOF while search lua block end marker [%s]. Found [%s]", luaEndBlockMarker, l.content[l.tokenStart:])
+	}
+	l.addToken(LuaBlock, lineNumber)
+
+	l.tokenStart = l.currentPosition
+	l.addToken(SYMBOL, l.currentLineNumber) //block where script will output the text
+	_lineNumber := l.currentLineNumber
+	l.skipChars(utf8.RuneCountInString(luaEndBlockMarker))
+	l.addToken(LUA_BLOCK_END, _lineNumber)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMarkersAfterPunctuationAndLetters(t *testing.T) {
+	tests := []struct {
+		name       string
+		delimiters [2]string
+		escape     string
+		input      string
+		expected   string
+	}{
+		{"start marker of punctuation after punctuation", [2]string{"{%", "%}"}, "\\", "a}{% echo(\"X\") %}b", "a}Xb"},
+		{"start marker of letters after letters", [2]string{"lua{", "}lua"}, "\\", "xlua{ echo(\"X\") }luay", "xXy"},
+		{"escaped start marker after punctuation", [2]string{"<?lua", "lua?>"}, "\\", "x!\\<?lua y", "x!<?lua y"},
+		{"punctuation escape character after punctuation", [2]string{"{%", "%}"}, "@", "}@{% x", "}{% x"},
+	}
+
+	defer setDelimiters("<?lua", "lua?>")
+	defer func() { escapeCharacter = "" }()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setDelimiters(test.delimiters[0], test.delimiters[1])
+			escapeCharacter = test.escape
+			output := processTestText(t, "", test.input)
+			if output != test.expected {
+				t.Errorf("Expected [%s] but found [%s]", test.expected, output)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// lineDirectiveFormat is a name of built-in line directive format or a custom format string. Empty means no line directives
+var lineDirectiveFormat string
+
+// lineBase is added to the 0-based line index in line directives
+var lineBase = 1
+
+// built-in line directive formats. {line} is replaced with the line number, {file} with the file path and {quotedFile} with the quoted file path
+var lineDirectiveFormats = map[string]string{
+	"c":      "#line {line} {quotedFile}",
+	"gas":    "# {line} {quotedFile}",
+	"nasm":   "%line {line}+1 {file}",
+	"python": "# line {line} {quotedFile}",
+}
+
+// resolveLineDirectiveFormat returns format string for built-in format name. Other values are used as custom format strings
+func resolveLineDirectiveFormat(format string) string {
+	if builtInFormat, exists := lineDirectiveFormats[format]; exists {
+		return builtInFormat
+	}
+	if !strings.Contains(format, "{line}") {
+		fail("Line directive format should be one of c, gas, nasm, python or custom format string with {line}, but found", format)
+	}
+	return format
+}
+
+func formatLineDirective(lineIndex int, filePath string) string {
+	return strings.NewReplacer(
+		"{line}", strconv.Itoa(lineIndex+lineBase),
+		"{file}", filePath,
+		"{quotedFile}", quoteFilePath(filePath),
+	).Replace(lineDirectiveFormat)
+}
+
+// quoteFilePath quotes the path as C string literal. The same quoting is understood by assemblers and is readable in python comments
+func quoteFilePath(filePath string) string {
+	var result strings.Builder
+	result.WriteByte('"')
+	for i := 0; i < len(filePath); i++ {
+		c := filePath[i]
+		switch {
+		case c == '"' || c == '\\':
+			result.WriteByte('\\')
+			result.WriteByte(c)
+		case c < ' ' || c == 0x7f:
+			result.WriteString(fmt.Sprintf("\\%03o", c))
+		default:
+			result.WriteByte(c)
+		}
+	}
+	result.WriteByte('"')
+	return result.String()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLineDirectivePlacement(t *testing.T) {
+	const macroCode = `macro("TWO", {}, function() echo("x\ny\n") end)`
+	tests := []struct {
+		name     string
+		inputs   []TestInput
+		expected string
+	}{
+		{
+			name:   "multi-line macro output is attributed to the invocation line",
+			inputs: []TestInput{{"a.tpl", "a\nTWO()\nb\n"}},
+			expected: "#line 1 \"a.tpl\"\na\nx\n" +
+				"#line 2 \"a.tpl\"\ny\n\n" +
+				"#line 3 \"a.tpl\"\nb\n",
+		},
+		{
+			name:   "several macros on one line",
+			inputs: []TestInput{{"a.tpl", "TWO() TWO()\n"}},
+			expected: "#line 1 \"a.tpl\"\nx\n" +
+				"#line 1 \"a.tpl\"\ny\n" +
+				"#line 1 \"a.tpl\"\n x\n" +
+				"#line 1 \"a.tpl\"\ny\n\n",
+		},
+		{
+			name:     "no directive on empty lines",
+			inputs:   []TestInput{{"a.tpl", "a\n<?lua x = 1 lua?>\n\nb\n"}},
+			expected: "#line 1 \"a.tpl\"\na\n\n\nb\n",
+		},
+		{
+			name:   "directive after removed multi-line lua block",
+			inputs: []TestInput{{"a.tpl", "a\n<?lua\nx = 1\nlua?>\nb\n"}},
+			expected: "#line 1 \"a.tpl\"\na\n\n" +
+				"#line 5 \"a.tpl\"\nb\n",
+		},
+		{
+			name:     "lua block output",
+			inputs:   []TestInput{{"a.tpl", "<?lua\necho(\"x\\ny\\n\")\nlua?>\nb\n"}},
+			expected: "#line 1 \"a.tpl\"\nx\n#line 1 \"a.tpl\"\ny\n\n#line 4 \"a.tpl\"\nb\n",
+		},
+		{
+			name:   "file switch",
+			inputs: []TestInput{{"a.tpl", "a\nb\n"}, {"b.tpl", "c\n"}, {"a.tpl", "d\n"}},
+			expected: "#line 1 \"a.tpl\"\na\nb\n" +
+				"#line 1 \"b.tpl\"\nc\n" +
+				"#line 1 \"a.tpl\"\nd\n",
+		},
+	}
+
+	lineDirectiveFormat = resolveLineDirectiveFormat("c")
+	defer func() { lineDirectiveFormat = "" }()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := processTestInputs(t, macroCode, test.inputs...)
+			if output != test.expected {
+				t.Errorf("Expected\n[%s]\nbut found\n[%s]", escapeStringForDebugPrint(test.expected), escapeStringForDebugPrint(output))
+			}
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	lspErrorMethodNotFound = -32601
+	lspSeverityError       = 1
+	lspCompletionFunction  = 3
+	lspTextDocumentSyncAll = 1
+)
+
+// LspServer is language server for template files. Documents are checked with the check command pipeline
+// every time they change, so lua blocks are never executed while the file is edited
+type LspServer struct {
+	processor *Processor
+	reader    *bufio.Reader
+	writer    io.Writer
+	documents map[string]*LspDocument
+	shutdown  bool
+}
+
+type LspDocument struct {
+	path string
+	text string
+	//macros of lua files and macros declared in lua blocks of the document, found by the last check
+	macroMap map[string]MacroStruct
+}
+
+type LspRequest struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+type LspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type LspRange struct {
+	Start LspPosition `json:"start"`
+	End   LspPosition `json:"end"`
+}
+
+type LspLocation struct {
+	URI   string   `json:"uri"`
+	Range LspRange `json:"range"`
+}
+
+type LspDiagnostic struct {
+	Range    LspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type LspTextDocument struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+type LspDocumentParams struct {
+	TextDocument   LspTextDocument `json:"textDocument"`
+	Position       LspPosition     `json:"position"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type LspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+type LspHover struct {
+	Contents struct {
+		Kind  string `json:"kind"`
+		Value string `json:"value"`
+	} `json:"contents"`
+	Range LspRange `json:"range"`
+}
+
+// lspCommand serves LSP over stdin and stdout. Stdout of lua code is redirected to stderr, so print in lua files does not break the protocol
+func lspCommand(arguments []string) {
+	if len(arguments) != 0 {
+		fail("lsp does not accept input files, but found", arguments[0])
+	}
+	loadProjectConfig()
+	if stdinUsed {
+		fail("Standard input cannot be used as lua file in lsp")
+	}
+	output := os.Stdout
+	os.Stdout = os.Stderr
+	processor, err := newProcessor(luaFiles)
+	defer processor.close()
+	if err != nil {
+		log(err.Error())
+	}
+
+	server := &LspServer{processor: processor, reader: bufio.NewReader(os.Stdin), writer: output, documents: make(map[string]*LspDocument)}
+	if err := server.run(); err != nil && err != io.EOF {
+		fail("LSP connection failed", err.Error())
+	}
+}
+
+func (s *LspServer) run() error {
+	for {
+		content, err := readLspMessage(s.reader)
+		if err != nil {
+			return err
+		}
+		var request LspRequest
+		if err := json.Unmarshal(content, &request); err != nil {
+			log("Cannot parse LSP message", err.Error())
+			continue
+		}
+		if request.Method == "exit" {
+			if !s.shutdown {
+				os.Exit(1)
+			}
+			return nil
+		}
+		s.handle(request)
+	}
+}
+
+func readLspMessage(reader *bufio.Reader) ([]byte, error) {
+	contentLength := -1
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		separatorIndex := strings.Index(line, ":")
+		if separatorIndex != -1 && strings.EqualFold(line[:separatorIndex], "Content-Length") {
+			contentLength, err = strconv.Atoi(strings.TrimSpace(line[separatorIndex+1:]))
+			if err != nil {
+				return nil, fmt.Errorf("wrong Content-Length header %s", line)
+			}
+		}
+	}
+	if contentLength < 0 {
+		return nil, errors.New("message without Content-Length header")
+	}
+	content := make([]byte, contentLength)
+	_, err := io.ReadFull(reader, content)
+	return content, err
+}
+
+func (s *LspServer) send(message map[string]interface{}) {
+	message["jsonrpc"] = "2.0"
+	content, _ := json.Marshal(message)
+	_, _ = fmt.Fprintf(s.writer, "Content-Length: %d\r\n\r\n%s", len(content), content)
+}
+
+func (s *LspServer) respond(request LspRequest, result interface{}) {
+	s.send(map[string]interface{}{"id": request.ID, "result": result})
+}
+
+func (s *LspServer) handle(request LspRequest) {
+	var params LspDocumentParams
+	_ = json.Unmarshal(request.Params, &params)
+	uri := params.TextDocument.URI
+
+	switch request.Method {
+	case "initialize":
+		s.respond(request, map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   lspTextDocumentSyncAll,
+				"hoverProvider":      true,
+				"definitionProvider": true,
+				"completionProvider": map[string]interface{}{},
+			},
+			"serverInfo": map[string]interface{}{"name": "luatp", "version": version},
+		})
+	case "shutdown":
+		s.shutdown = true
+		s.respond(request, nil)
+	case "textDocument/didOpen":
+		s.updateDocument(uri, params.TextDocument.Text)
+	case "textDocument/didChange":
+		if len(params.ContentChanges) != 0 {
+			s.updateDocument(uri, params.ContentChanges[len(params.ContentChanges)-1].Text)
+		}
+	case "textDocument/didClose":
+		delete(s.documents, uri)
+		s.publishDiagnostics(uri, []LspDiagnostic{})
+	case "textDocument/hover":
+		s.respond(request, s.hover(uri, params.Position))
+	case "textDocument/definition":
+		s.respond(request, s.definition(uri, params.Position))
+	case "textDocument/completion":
+		s.respond(request, s.completion(uri))
+	default:
+		//notifications without handlers are ignored, requests must get a response
+		if request.ID != nil {
+			s.send(map[string]interface{}{"id": request.ID, "error": map[string]interface{}{
+				"code": lspErrorMethodNotFound, "message": "Method " + request.Method + " is not supported"}})
+		}
+	}
+}
+
+// updateDocument checks the new text of the document and publishes found problems
+func (s *LspServer) updateDocument(uri string, text string) {
+	document := &LspDocument{path: uriToPath(uri), text: text}
+	s.processor.macroMap = copyMacroMap(s.processor.librariesMacroMap)
+	problems := s.processor.checkContent(text, document.path)
+	document.macroMap = s.processor.macroMap
+	s.documents[uri] = document
+
+	lines := strings.Split(text, "\n")
+	diagnostics := []LspDiagnostic{}
+	for _, problem := range problems {
+		diagnostics = append(diagnostics, LspDiagnostic{problemRange(lines, problem), lspSeverityError, "luatp", problem.message})
+	}
+	s.publishDiagnostics(uri, diagnostics)
+}
+
+func (s *LspServer) publishDiagnostics(uri string, diagnostics []LspDiagnostic) {
+	s.send(map[string]interface{}{"method": "textDocument/publishDiagnostics", "params": map[string]interface{}{
+		"uri": uri, "diagnostics": diagnostics}})
+}
+
+// problemRange returns range of the word where the problem was found. Problems without column cover the whole line
+func problemRange(lines []string, problem CheckProblem) LspRange {
+	lineIndex := problem.line - 1
+	if lineIndex < 0 || lineIndex >= len(lines) {
+		return LspRange{}
+	}
+	line := strings.TrimSuffix(lines[lineIndex], "\r")
+	if problem.column <= 0 {
+		return LspRange{LspPosition{lineIndex, 0}, LspPosition{lineIndex, utf16Length(line)}}
+	}
+	start := problem.column - 1
+	if start > len(line) {
+		start = len(line)
+	}
+	end := start
+	for i, c := range line[start:] {
+		if unicode.IsSpace(c) && i != 0 {
+			break
+		}
+		end += len(string(c))
+	}
+	return LspRange{LspPosition{lineIndex, utf16Length(line[:start])}, LspPosition{lineIndex, utf16Length(line[:end])}}
+}
+
+// macroAt returns the macro invoked at the position and the range of its name
+func (s *LspServer) macroAt(uri string, position LspPosition) (MacroStruct, LspRange, bool) {
+	document, exists := s.documents[uri]
+	if !exists {
+		return MacroStruct{}, LspRange{}, false
+	}
+	lines := strings.Split(document.text, "\n")
+	if position.Line >= len(lines) {
+		return MacroStruct{}, LspRange{}, false
+	}
+	line := lines[position.Line]
+	column := utf16Offset(line, position.Character)
+
+	//the document can have unfinished lua blocks while it is edited, so tokens are collected even if the lexer fails
+	var tokens *TokenList
+	_ = runProcessing(func() {
+		lexer := newLexer(line, document.path)
+		tokens = lexer.tokens
+		lexer.tokenize()
+	})
+	for i := tokens.first(); i != noToken; i = tokens.next(i) {
+		token := tokens.get(i)
+		if token.tokenType != SYMBOL || int(token.start) > column || column > int(token.end) {
+			continue
+		}
+		macro, exists := document.macroMap[token.text()]
+		start := LspPosition{position.Line, utf16Length(line[:token.start])}
+		end := LspPosition{position.Line, utf16Length(line[:token.end])}
+		return macro, LspRange{start, end}, exists
+	}
+	return MacroStruct{}, LspRange{}, false
+}
+
+func (s *LspServer) hover(uri string, position LspPosition) interface{} {
+	macro, nameRange, found := s.macroAt(uri, position)
+	if !found {
+		return nil
+	}
+	description := describeMacro(macro)
+	hover := LspHover{Range: nameRange}
+	hover.Contents.Kind = "markdown"
+	hover.Contents.Value = "```\n" + description.signature() + "\n```"
+	if description.File != "" {
+		hover.Contents.Value += fmt.Sprintf("\nDefined at %s:%d", description.File, description.Line)
+	}
+	return hover
+}
+
+// definition returns location of the macro() call that declared the macro
+func (s *LspServer) definition(uri string, position LspPosition) interface{} {
+	macro, _, found := s.macroAt(uri, position)
+	if !found || macro.definitionFile == "" || macro.definitionFile == stdinName {
+		return nil
+	}
+	definitionPosition := LspPosition{macro.definitionLine - 1, 0}
+	return LspLocation{pathToUri(macro.definitionFile), LspRange{definitionPosition, definitionPosition}}
+}
+
+func (s *LspServer) completion(uri string) []LspCompletionItem {
+	macroMap := s.processor.librariesMacroMap
+	if document, exists := s.documents[uri]; exists {
+		macroMap = document.macroMap
+	}
+	items := []LspCompletionItem{}
+	for _, description := range describeMacros(macroMap) {
+		items = append(items, LspCompletionItem{description.Name, lspCompletionFunction, description.signature()})
+	}
+	return items
+}
+
+// utf16Length returns length of the text in UTF-16 code units, which LSP uses for columns
+func utf16Length(text string) int {
+	length := 0
+	for _, c := range text {
+		if c >= 0x10000 {
+			length += 2
+		} else {
+			length++
+		}
+	}
+	return length
+}
+
+// utf16Offset converts LSP column of the line to the byte offset
+func utf16Offset(line string, character int) int {
+	length := 0
+	for offset, c := range line {
+		if length >= character {
+			return offset
+		}
+		length += utf16Length(string(c))
+	}
+	return len(line)
+}
+
+func uriToPath(uri string) string {
+	parsedUri, err := url.Parse(uri)
+	if err != nil || parsedUri.Scheme != "file" {
+		return uri
+	}
+	filePath := parsedUri.Path
+	//windows paths look like /C:/dir/file
+	if len(filePath) > 2 && filePath[0] == '/' && filePath[2] == ':' {
+		filePath = filePath[1:]
+	}
+	return filepath.FromSlash(filePath)
+}
+
+func pathToUri(filePath string) string {
+	absolutePath, err := filepath.Abs(filePath)
+	if err == nil {
+		filePath = absolutePath
+	}
+	filePath = filepath.ToSlash(filePath)
+	if !strings.HasPrefix(filePath, "/") {
+		filePath = "/" + filePath
+	}
+	return (&url.URL{Scheme: "file", Path: filePath}).String()
+}
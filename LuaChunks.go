@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"strings"
+)
+
+// loadLuaChunk compiles lua code of the file. The chunk is named after the file and its lines start from firstLineIndex,
+// so lua errors, tracebacks and debug information show lines of the file instead of lines of the lua block
+func loadLuaChunk(L *lua.LState, code string, file string, firstLineIndex int) (*lua.LFunction, error) {
+	chunk, err := parse.Parse(strings.NewReader(code), file)
+	if err != nil {
+		if parseError, ok := err.(*parse.Error); ok && parseError.Pos.Line != parse.EOF {
+			parseError.Pos.Line += firstLineIndex
+		}
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, file)
+	if err != nil {
+		if compileError, ok := err.(*lua.CompileError); ok {
+			compileError.Line += firstLineIndex
+		}
+		return nil, err
+	}
+	shiftProtoLines(proto, firstLineIndex)
+	return L.NewFunctionFromProto(proto), nil
+}
+
+func shiftProtoLines(proto *lua.FunctionProto, offset int) {
+	if offset == 0 {
+		return
+	}
+	//main chunk has line 0, as in the standard lua
+	if proto.LineDefined != 0 {
+		proto.LineDefined += offset
+		proto.LastLineDefined += offset
+	}
+	for i := range proto.DbgSourcePositions {
+		proto.DbgSourcePositions[i] += offset
+	}
+	for _, childProto := range proto.FunctionPrototypes {
+		shiftProtoLines(childProto, offset)
+	}
+}
+
+// runLuaChunk loads and executes lua code of the file. Returned error has the lua traceback
+func (p *Processor) runLuaChunk(code string, file string, firstLineIndex int) error {
+	function, err := loadLuaChunk(p.luaState, code, file, firstLineIndex)
+	if err != nil {
+		return err
+	}
+	p.luaState.Push(function)
+	return p.luaState.PCall(0, 0, nil)
+}
+
+// describeLuaError returns the lua error with its traceback and the macro invocation or lua block where lua code was called from
+func (p *Processor) describeLuaError(err error) string {
+	var description strings.Builder
+	if apiError, ok := err.(*lua.ApiError); ok {
+		description.WriteString(apiError.Object.String())
+		if apiError.StackTrace != "" {
+			description.WriteString("\n" + apiError.StackTrace)
+		}
+	} else {
+		description.WriteString(strings.TrimSpace(err.Error()))
+	}
+	if p.currentProducer != nil {
+		producer := p.currentProducer
+		if producer.Kind == "macro" {
+			description.WriteString(fmt.Sprintf("\n\tin macro [%s] invoked at %s:%d", producer.Name, producer.Source, producer.Line))
+		} else {
+			description.WriteString(fmt.Sprintf("\n\tin lua block at %s:%d", producer.Source, producer.Line))
+		}
+	}
+	return description.String()
+}
+
+// luaCallerLocation returns file and line of the lua code that called the go function. Go functions like pcall are skipped
+func luaCallerLocation(L *lua.LState) (string, int) {
+	for level := 1; ; level++ {
+		debug, ok := L.GetStack(level)
+		if !ok {
+			return "", 0
+		}
+		if _, err := L.GetInfo("Sl", debug, lua.LNil); err != nil {
+			return "", 0
+		}
+		if debug.CurrentLine > 0 {
+			return debug.Source, debug.CurrentLine
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+var macrosJsonOutput = false
+
+// MacroDescription is the macro as it is shown by the macros command
+type MacroDescription struct {
+	Name      string   `json:"name"`
+	Arguments []string `json:"arguments"`
+	Variadic  bool     `json:"variadic"`
+	File      string   `json:"file"`
+	Line      int      `json:"line"`
+}
+
+// macrosCommand prints macros declared in lua files. When inputs are provided, they are processed without writing outputs and their macros are shown too
+func macrosCommand(arguments []string) {
+	for _, argument := range arguments {
+		addInputFile(argument)
+	}
+	loadProjectConfig()
+
+	processor, err := newProcessor(luaFiles)
+	defer processor.close()
+	if err != nil {
+		fail(err.Error())
+	}
+	macroMap := copyMacroMap(processor.macroMap)
+	if len(filesToProcess) != 0 || len(configJobs) != 0 {
+		discardOutputs = true
+		for _, job := range createAllProcessingJobs() {
+			//every job has its own lua state, as in the run command
+			jobProcessor, err := newProcessor(luaFiles)
+			if err != nil {
+				fail(err.Error())
+			}
+			result := jobProcessor.processJob(job)
+			jobProcessor.close()
+			if result.err != nil {
+				fail(result.err.Error())
+			}
+			for name, macro := range jobProcessor.macroMap {
+				macroMap[name] = macro
+			}
+		}
+	}
+
+	descriptions := describeMacros(macroMap)
+	if macrosJsonOutput {
+		content, _ := json.MarshalIndent(descriptions, "", "  ")
+		fmt.Println(string(content))
+		return
+	}
+	printMacros(os.Stdout, descriptions)
+}
+
+func printMacros(output io.Writer, descriptions []MacroDescription) {
+	writer := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(writer, "NAME\tARGUMENTS\tVARIADIC\tDEFINED AT")
+	for _, description := range descriptions {
+		variadic := "no"
+		if description.Variadic {
+			variadic = "yes"
+		}
+		_, _ = fmt.Fprintf(writer, "%s\t%s\t%s\t%s:%d\n", description.Name, strings.Join(description.Arguments, ", "), variadic, description.File, description.Line)
+	}
+	_ = writer.Flush()
+}
+
+// describeMacros returns macros sorted by name. Type of variadic argument is shown with '*', as it is declared
+func describeMacros(macroMap map[string]MacroStruct) []MacroDescription {
+	descriptions := []MacroDescription{}
+	for _, macro := range macroMap {
+		descriptions = append(descriptions, describeMacro(macro))
+	}
+	sort.Slice(descriptions, func(i, j int) bool { return descriptions[i].Name < descriptions[j].Name })
+	return descriptions
+}
+
+func describeMacro(macro MacroStruct) MacroDescription {
+	arguments := append([]string{}, macro.arguments...)
+	if macro.variadic && len(arguments) > 0 {
+		arguments[len(arguments)-1] += "*"
+	}
+	return MacroDescription{macro.name, arguments, macro.variadic, macro.definitionFile, macro.definitionLine}
+}
+
+// signature returns the macro as it is invoked, for example LIST(raw, raw*)
+func (description MacroDescription) signature() string {
+	return description.Name + "(" + strings.Join(description.Arguments, ", ") + ")"
+}
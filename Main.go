@@ -3,19 +3,33 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 )
 
 const version = "0.2"
 
 var filesToProcess []string
-var outputFilePath = "console"
+var outputFilePaths []string
+var outputDirectory string
+var outputExtensionRewrite string
+var outputExtensionRewriteProvided = false
 var luaFiles []string
+var watchMode = false
+var stdinUsed = false
 
 func log(message ...interface{}) {
 	_, _ = fmt.Fprintln(os.Stderr, message...)
 }
 
+// failuresRecoverable makes fail report ProcessingError instead of exiting. Watch mode sets it while inputs are expanded again,
+// so files removed from a watched directory do not stop watching
+var failuresRecoverable = false
+
 func fail(message ...interface{}) {
+	if failuresRecoverable {
+		panic(&ProcessingError{message: strings.TrimSuffix(fmt.Sprintln(message...), "\n")})
+	}
 	log(message...)
 	os.Exit(1)
 }
@@ -25,80 +39,263 @@ func checkFileExists(filePath string) bool {
 	return err == nil
 }
 
-func checkCommandLineArgExists(argIndex int, errorMessage string) {
-	if argIndex >= len(os.Args) {
-		fail(errorMessage)
+func useStdin() {
+	if stdinUsed {
+		fail("Standard input '-' can be used only once")
 	}
+	stdinUsed = true
 }
 
-func parseCommandLine() {
-	commandLineArgs := os.Args
-	commandLineArgsCount := len(commandLineArgs)
-	if commandLineArgsCount == 1 {
-		printHelp(false)
-		os.Exit(1)
+func addInputFile(inputFilePath string) {
+	if inputFilePath == stdinPath {
+		useStdin()
+	} else if !checkFileExists(inputFilePath) && !hasGlobMeta(inputFilePath) {
+		fail("Provided input file", inputFilePath, "does not exists")
 	}
+	filesToProcess = append(filesToProcess, inputFilePath)
+}
 
-	for i := 1; i < commandLineArgsCount; i++ {
-		arg := commandLineArgs[i]
-		if arg == "-v" || arg == "--version" {
-			printVersion()
-			os.Exit(0)
-		} else if arg == "-h" || arg == "--help" {
-			printHelp(true)
-			os.Exit(0)
-		} else if arg == "-l" {
-			i++
-			checkCommandLineArgExists(i, "You should provide lua file after -l")
-			libraryFilePath := commandLineArgs[i]
-			if !checkFileExists(libraryFilePath) {
-				fail("Provided lua file", libraryFilePath, "does not exists")
-			}
+func addLuaFile(libraryFilePath string) {
+	if libraryFilePath == stdinPath {
+		useStdin()
+	} else if !checkFileExists(libraryFilePath) {
+		fail("Provided lua file", libraryFilePath, "does not exists")
+	}
+	luaFiles = append(luaFiles, libraryFilePath)
+}
 
-			luaFiles = append(luaFiles, libraryFilePath)
-		} else if arg == "-f" {
-			i++
-			checkCommandLineArgExists(i, "You should provide input file after -i")
-			inputFilePath := commandLineArgs[i]
-			if !checkFileExists(inputFilePath) {
-				fail("Provided input file", inputFilePath, "does not exists")
+// inputFlags are flags of every command that reads inputs and lua files
+func inputFlags() []*CommandLineFlag {
+	return []*CommandLineFlag{
+		{"f", "file", "FILE", "file to process. '-' - read from standard input. Files can also be provided without flag\n" +
+			"Directories are processed recursively, glob patterns like 'src/**/*.tpl' are supported", addInputFile},
+		{"l", "lib", "FILE", "lua file that is executed before processing input files. '-' - read from standard input", addLuaFile},
+		{"", "include", "PATTERN", "process only files from directories and glob patterns that match the pattern", func(value string) {
+			includePatterns = append(includePatterns, value)
+		}},
+		{"", "exclude", "PATTERN", "skip files from directories and glob patterns that match the pattern", func(value string) {
+			excludePatterns = append(excludePatterns, value)
+		}},
+		{"", "stdin-name", "NAME", "file name of standard input used in error messages and line information. Default - '<stdin>'", func(value string) {
+			stdinName = value
+		}},
+		{"D", "define", "NAME=VALUE", "define lua global string variable. NAME alone means NAME=1", addDefine},
+		{"", "delimiters", "'START END'", "start and end of lua blocks separated by space. Default - '<?lua lua?>'", func(value string) {
+			delimiters := strings.Fields(value)
+			if len(delimiters) != 2 {
+				fail("Expected start and end delimiters separated by space, but found", value)
 			}
+			setDelimiters(delimiters[0], delimiters[1])
+			delimitersProvided = true
+		}},
+		{"", "escape", "CHAR", "character that makes following macro name or lua block start marker plain text, for example '\\'. Escaping is disabled by default", func(value string) {
+			setEscapeCharacter(value)
+			escapeCharacterProvided = true
+		}},
+		{"", "sandbox", "", "remove lua functions that can change files or run processes", func(string) {
+			sandboxMode = true
+		}},
+		{"", "config", "FILE", "project config file. Default - luatp.json in the current directory, if it exists", func(value string) {
+			configPath = value
+		}},
+		{"", "job", "NAME", "process only the config job with provided name. Can be provided several times", func(value string) {
+			selectedJobNames = append(selectedJobNames, value)
+		}},
+	}
+}
 
-			filesToProcess = append(filesToProcess, inputFilePath)
-		} else if arg == "-o" {
-			i++
-			checkCommandLineArgExists(i, "You should provide output file path after -o")
-			outputFilePath = commandLineArgs[i]
-		} else {
-			fail("Unknown command line flag", arg)
+// luaStateFlags returns input flags that change the lua state, for commands that do not process input files
+func luaStateFlags() []*CommandLineFlag {
+	var flags []*CommandLineFlag
+	for _, flag := range inputFlags() {
+		if containsString([]string{"lib", "define", "delimiters", "escape", "sandbox", "config"}, flag.longName) {
+			flags = append(flags, flag)
 		}
 	}
+	return flags
+}
+
+// outputFlags are flags of the run command that control outputs
+func outputFlags() []*CommandLineFlag {
+	return []*CommandLineFlag{
+		{"o", "output", "FILE", "output file. If 'console' or '-' - output will be redirected to console. Default - 'console'\n" +
+			"If -o is provided for every -f, each input file is written to its own output", func(value string) {
+			outputFilePaths = append(outputFilePaths, value)
+		}},
+		{"", "out-dir", "DIR", "directory where each input file is written to its own output, mirroring the input paths", func(value string) {
+			outputDirectory = value
+		}},
+		{"", "out-ext", "FROM=TO", "extension rewrite for --out-dir, for example .tpl= or .txt=.out. Default - remove the last extension", func(value string) {
+			outputExtensionRewrite = value
+			outputExtensionRewriteProvided = true
+		}},
+		{"j", "jobs", "N", "number of inputs processed in parallel when every input has its own output. Default - 1", func(value string) {
+			jobsCount, err := strconv.Atoi(value)
+			if err != nil || jobsCount < 1 {
+				fail("Number of parallel jobs should be positive number, but found", value)
+			}
+			parallelJobsCount = jobsCount
+		}},
+		{"M", "", "", "write Makefile dependency rule instead of the output. Rule is written to console or to -MF file", func(string) {
+			dependenciesOnly = true
+			discardOutputs = true
+		}},
+		{"MD", "", "", "write Makefile dependency rule in addition to the output. Default file - output path with '.d' suffix", func(string) {
+			writeDependencies = true
+		}},
+		{"MF", "", "FILE", "file for the dependency rule", func(value string) {
+			dependencyFilePath = value
+		}},
+		{"MT", "", "TARGET", "target name of the dependency rule. Default - output file path", func(value string) {
+			dependencyTarget = value
+		}},
+		{"", "line-directives", "FORMAT", "line directives written where output goes out of sync with input: c, gas, nasm, python\n" +
+			"or custom format with {line}, {file} and {quotedFile}, for example '--line-directives=-- {line} {file}'", func(value string) {
+			lineDirectiveFormat = resolveLineDirectiveFormat(value)
+		}},
+		{"", "line-base", "0|1", "number of the first line in line directives. Default - 1", func(value string) {
+			if value != "0" && value != "1" {
+				fail("Line base should be 0 or 1, but found", value)
+			}
+			lineBase, _ = strconv.Atoi(value)
+			lineBaseProvided = true
+		}},
+		{"", "preserve-lines", "", "replace lua blocks and multi-line macro invocations with new lines, so output lines match input lines", func(string) {
+			preserveLines = true
+		}},
+		{"", "source-map", "FILE", "JSON file that maps every output line to the input file, line and macro or lua block that produced it", func(value string) {
+			sourceMapPath = value
+		}},
+		{"", "stream", "", "read inputs by chunks and write text as soon as no open marked block can receive it", func(string) {
+			streamMode = true
+		}},
+		{"", "trace-tokens", "FORMAT", "write token lists of input files before and after execution to stderr as text or json", func(value string) {
+			tokenTraceFormat = resolveTokenTraceFormat(value)
+		}},
+		{"", "trace", "", "write every executed lua block and macro expansion with its arguments, emitted text and time to stderr", func(string) {
+			traceEnabled = true
+		}},
+		{"", "trace-file", "FILE", "write the trace to the file instead of stderr. Enables --trace", func(value string) {
+			traceEnabled = true
+			traceFilePath = value
+		}},
+		{"W", "warning", "NAME", "enable warning: " + strings.Join(warningCategories(), ", ") + ". -Wno-NAME disables it\n" +
+			"-Wall enables all warnings, -Werror makes processing fail when there are warnings", setWarningOption},
+		{"", "watch", "", "process files again every time input, lua or any other used file changes", func(string) {
+			watchMode = true
+		}},
+	}
 }
+
+func init() {
+	commands = []*Command{
+		{
+			name:        "run",
+			arguments:   "[files]",
+			description: "Process input files and write the result",
+			flags:       append(inputFlags(), outputFlags()...),
+			run:         runCommand,
+		},
+		{
+			name:        "check",
+			arguments:   "[files]",
+			description: "Check lua syntax, lua block markers and macro invocations without running lua blocks and writing outputs",
+			flags:       inputFlags(),
+			run:         checkCommand,
+		},
+		{
+			name:        "macros",
+			arguments:   "[files]",
+			description: "List macros declared in lua files, and in input files if they are provided",
+			flags: append(inputFlags(), &CommandLineFlag{"", "json", "", "write macros as JSON", func(string) {
+				macrosJsonOutput = true
+			}}),
+			run: macrosCommand,
+		},
+		{
+			name:        "tokens",
+			arguments:   "[files]",
+			description: "Show tokens of input files with their types, locations and text",
+			flags: append(inputFlags(),
+				&CommandLineFlag{"", "json", "", "write every token list as JSON on its own line", func(string) {
+					tokenTraceFormat = "json"
+				}},
+				&CommandLineFlag{"", "executed", "", "run lua blocks and macros without writing outputs, and show token lists after execution too", func(string) {
+					tokensExecuted = true
+				}}),
+			run: tokensCommand,
+		},
+		{
+			name:        "repl",
+			description: "Load lua files and process template text or lua code typed line by line",
+			flags:       luaStateFlags(),
+			run:         replCommand,
+		},
+		{
+			name:        "lsp",
+			description: "Run language server for template files over standard input and output",
+			flags:       luaStateFlags(),
+			run:         lspCommand,
+		},
+		{
+			name:        "help",
+			arguments:   "[command]",
+			description: "Show help of the command",
+			run:         printCommandHelp,
+		},
+		{
+			name:        "version",
+			description: "Show version",
+			run: func([]string) {
+				printVersion()
+			},
+		},
+	}
+}
+
 func printVersion() {
 	fmt.Println("luatp " + version)
 	fmt.Println("https://github.com/Otaka/LuaTextProcessor")
 }
 
-func printHelp(showFullHelp bool) {
-	fmt.Println("luatp\nLua Text Preprocessor - tool that can preprocess text with lua scripts")
-	fmt.Println("Usage: luatp -f sourcefile")
-	if showFullHelp {
-		fmt.Println("Command line flags:")
-		fmt.Println("\t-f\t\t\t\tfile to process")
-		fmt.Println("\t-o\t\t\t\toutput file. If 'console' - output will be redirected to console. Default - 'console'")
-		fmt.Println("\t-l\t\t\t\tfile that should be processed before processing main file")
-		fmt.Println("\t-h, --help\t\tShow help")
-		fmt.Println("\t-v, --version\tShow version")
+// loadInputs adds files provided without flag to the inputs and applies the project config
+func loadInputs(arguments []string) {
+	for _, argument := range arguments {
+		addInputFile(argument)
 	}
+	loadProjectConfig()
+	if len(filesToProcess) == 0 && len(configJobs) == 0 {
+		fail("Input file does not specified. Please provide -f input_file_path arguments or inputs in the config file")
+	}
+}
 
-	fmt.Println()
+func runCommand(arguments []string) {
+	loadInputs(arguments)
+	jobs := createAllProcessingJobs()
+	checkDependencyFileOutputs(jobs)
+	if streamMode && tokenTraceFormat != "" {
+		fail("Flags --stream and --trace-tokens cannot be used together, because streaming mode does not keep the whole token list")
+	}
+	openTraceLog()
+	if watchMode {
+		if stdinUsed {
+			fail("Standard input cannot be used in watch mode")
+		}
+		watchFiles(luaFiles, jobs)
+	}
+
+	_, err := processFiles(luaFiles, jobs)
+	if err != nil {
+		fail(err.Error())
+	}
 }
 
 func main() {
-	parseCommandLine()
-	if len(filesToProcess) == 0 {
-		fail("Input file does not specified. Please provide -f input_file_path arguments")
+	if len(os.Args) == 1 && !checkFileExists(defaultConfigPath) {
+		fmt.Println("luatp\nLua Text Preprocessor - tool that can preprocess text with lua scripts")
+		fmt.Println("Usage: luatp [command] [flags] [files]. Run 'luatp --help' to see commands and flags")
+		os.Exit(1)
 	}
-
-	processFiles(luaFiles, filesToProcess, outputFilePath)
+	command, arguments := parseCommandLine(os.Args[1:])
+	command.run(arguments)
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const mainOutputName = ""
+
+// discardOutputs is set when only dependency information is requested
+var discardOutputs = false
+
+type OutputTarget struct {
+	path   string
+	writer *bufio.Writer
+	file   *os.File
+	//console and diverted outputs are kept in memory until the job is finished, because jobs can be processed in parallel
+	buffer *bytes.Buffer
+	//line of the input that the reader of the output expects for the current output line, according to the last line information
+	expectedLineIndex int
+	expectedFile      string
+	atLineStart       bool
+	//new lines written by lua blocks and macros over the lines they replaced. Used by --preserve-lines to catch up with the input
+	extraLinesCount int
+	sourceMap       *OutputSourceMap
+}
+
+// OutputSet holds the main output of a job and outputs diverted with beginOutput
+type OutputSet struct {
+	targets map[string]*OutputTarget
+	//diverted outputs in order of the first use
+	order []string
+}
+
+// DivertedFiles holds diverted output files shared by all jobs
+type DivertedFiles struct {
+	files map[string]*os.File
+}
+
+func newBufferedTarget(path string) *OutputTarget {
+	target := &OutputTarget{path: path, buffer: new(bytes.Buffer), atLineStart: true, sourceMap: newOutputSourceMap(path)}
+	target.writer = bufio.NewWriter(target.buffer)
+	return target
+}
+
+func newOutputSet(mainOutputPath string) *OutputSet {
+	outputs := &OutputSet{targets: make(map[string]*OutputTarget)}
+	var target *OutputTarget
+	if discardOutputs {
+		target = &OutputTarget{path: mainOutputPath, writer: bufio.NewWriter(ioutil.Discard)}
+	} else if isConsolePath(mainOutputPath) && streamMode && parallelJobsCount == 1 {
+		//streaming output is not buffered, because jobs are processed one by one
+		target = &OutputTarget{path: mainOutputPath, writer: bufio.NewWriter(os.Stdout)}
+	} else if isConsolePath(mainOutputPath) {
+		target = newBufferedTarget(mainOutputPath)
+	} else {
+		target = &OutputTarget{path: mainOutputPath, file: createOutputFile(mainOutputPath)}
+		target.writer = bufio.NewWriter(target.file)
+	}
+	target.atLineStart = true
+	target.sourceMap = newOutputSourceMap(mainOutputPath)
+	outputs.targets[mainOutputName] = target
+	return outputs
+}
+
+func createOutputFile(outputPath string) *os.File {
+	directory := filepath.Dir(outputPath)
+	if err := os.MkdirAll(directory, os.ModePerm); err != nil {
+		reportError(nil, "Cannot create output directory %s\n%s", directory, err.Error())
+	}
+	file, err := os.Create(outputPath)
+	if err != nil {
+		reportError(nil, "Cannot create output file %s\n%s", outputPath, err.Error())
+	}
+	return file
+}
+
+// write writes text to the output and records it in the source map. Empty source means that the text is not mapped
+func (t *OutputTarget) write(text string, source string, sourceLineIndex int, producer *Producer) {
+	_, _ = t.writer.WriteString(text)
+	if t.sourceMap != nil {
+		t.sourceMap.add(text, source, sourceLineIndex, producer)
+	}
+}
+
+func (o *OutputSet) mainPath() string {
+	return o.targets[mainOutputName].path
+}
+
+// target returns the output with provided name. Diverted outputs are created on first use
+func (o *OutputSet) target(name string) *OutputTarget {
+	target, exists := o.targets[name]
+	if !exists {
+		target = newBufferedTarget(name)
+		o.targets[name] = target
+		o.order = append(o.order, name)
+	}
+	return target
+}
+
+func (o *OutputSet) flushAll() {
+	for _, target := range o.targets {
+		_ = target.writer.Flush()
+	}
+}
+
+func (o *OutputSet) closeMain() {
+	target := o.targets[mainOutputName]
+	_ = target.writer.Flush()
+	if target.file != nil {
+		_ = target.file.Close()
+	}
+}
+
+// writeBuffered writes the console output to stdout and appends diverted outputs to their files
+func (o *OutputSet) writeBuffered(divertedFiles *DivertedFiles) {
+	o.flushAll()
+	if discardOutputs {
+		return
+	}
+	mainTarget := o.targets[mainOutputName]
+	if mainTarget.buffer != nil {
+		_, _ = os.Stdout.Write(mainTarget.buffer.Bytes())
+	}
+	for _, name := range o.order {
+		_, _ = divertedFiles.file(name).Write(o.targets[name].buffer.Bytes())
+	}
+}
+
+func newDivertedFiles() *DivertedFiles {
+	return &DivertedFiles{files: make(map[string]*os.File)}
+}
+
+func (d *DivertedFiles) file(name string) *os.File {
+	file, exists := d.files[name]
+	if !exists {
+		file = createOutputFile(name)
+		d.files[name] = file
+	}
+	return file
+}
+
+func (d *DivertedFiles) closeAll() {
+	for _, file := range d.files {
+		_ = file.Close()
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Processor) resetOutputStack() {
+	p.outputStack = nil
+	p.currentOutput = mainOutputName
+}
+
+func sameFilePath(path1 string, path2 string) bool {
+	absPath1, err1 := filepath.Abs(path1)
+	absPath2, err2 := filepath.Abs(path2)
+	if err1 != nil || err2 != nil {
+		return path1 == path2
+	}
+	return absPath1 == absPath2
+}
+
+func (p *Processor) BeginOutput(L *lua.LState) int {
+	L.CheckString(1)
+	outputPath := L.ToString(1)
+	if outputPath == "" {
+		reportError(nil, "beginOutput expects non empty output file path")
+	}
+	mainPath := p.outputs.mainPath()
+	if !isConsolePath(mainPath) && sameFilePath(outputPath, mainPath) {
+		reportError(nil, "Cannot divert output to [%s], because it is the main output file", outputPath)
+	}
+
+	p.outputStack = append(p.outputStack, p.currentOutput)
+	p.currentOutput = filepath.Clean(outputPath)
+	return 0
+}
+
+func (p *Processor) EndOutput(L *lua.LState) int {
+	if len(p.outputStack) == 0 {
+		reportError(nil, "endOutput called without matching beginOutput")
+	}
+	n := len(p.outputStack) - 1
+	p.currentOutput = p.outputStack[n]
+	p.outputStack = p.outputStack[:n]
+	return 0
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// replFileName is the file name of the repl input used in error messages and macro locations
+const replFileName = "<repl>"
+
+const replHelp = `Lines are processed as template text and the result is printed at once.
+Commands:
+  :lua        process following lines as lua code. Values of lua expressions are printed
+  :lua CODE   execute one line of lua code
+  :text       process following lines as template text
+  :macros     list declared macros
+  :blocks     show marked blocks and their text
+  :cancel     drop lines collected for unfinished lua block or lua statement
+  :help       show this help
+  :quit       exit
+Lines are collected until lua block or lua statement is finished`
+
+// Repl keeps the processor between lines, so macros and marked blocks declared in one line are available in the next ones
+type Repl struct {
+	processor *Processor
+	output    io.Writer
+	luaMode   bool
+}
+
+func replCommand(arguments []string) {
+	if len(arguments) != 0 {
+		fail("repl does not accept input files, but found", arguments[0])
+	}
+	loadProjectConfig()
+	if stdinUsed {
+		fail("Standard input cannot be used as lua file in repl")
+	}
+	processor, err := newProcessor(luaFiles)
+	defer processor.close()
+	if err != nil {
+		fail(err.Error())
+	}
+	discardOutputs = true
+	processor.outputs = newOutputSet("console")
+	processor.resetOutputStack()
+
+	repl := &Repl{processor: processor, output: os.Stdout}
+	repl.run(os.Stdin)
+}
+
+func (r *Repl) run(input io.Reader) {
+	_, _ = fmt.Fprintf(r.output, "LuaTextProcessor %s. Type :help for help\n", version)
+	scanner := bufio.NewScanner(input)
+	pending := ""
+	r.prompt(pending)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == ":cancel" {
+			//works in the middle of unfinished block or statement, when other commands are collected as its lines
+			pending = ""
+		} else if pending == "" && strings.HasPrefix(line, ":") {
+			if !r.executeCommand(line) {
+				return
+			}
+		} else {
+			pending += line + "\n"
+			if r.luaMode && !luaChunkIncomplete(pending) {
+				r.executeLua(pending)
+				pending = ""
+			} else if !r.luaMode && strings.Count(pending, luaStartBlockMarker) <= strings.Count(pending, luaEndBlockMarker) {
+				r.executeText(pending)
+				pending = ""
+			}
+		}
+		r.prompt(pending)
+	}
+	_, _ = fmt.Fprintln(r.output)
+}
+
+func (r *Repl) prompt(pending string) {
+	if pending != "" {
+		_, _ = fmt.Fprint(r.output, "...> ")
+	} else if r.luaMode {
+		_, _ = fmt.Fprint(r.output, "lua> ")
+	} else {
+		_, _ = fmt.Fprint(r.output, "tpl> ")
+	}
+}
+
+// executeCommand executes the repl command. Returns false when the repl should exit
+func (r *Repl) executeCommand(line string) bool {
+	name, argument := line, ""
+	if separatorIndex := strings.IndexAny(line, " \t"); separatorIndex != -1 {
+		name, argument = line[:separatorIndex], strings.TrimSpace(line[separatorIndex+1:])
+	}
+	switch name {
+	case ":lua":
+		if argument == "" {
+			r.luaMode = true
+		} else {
+			r.executeLua(argument)
+		}
+	case ":text":
+		r.luaMode = false
+	case ":macros":
+		printMacros(r.output, describeMacros(r.processor.macroMap))
+	case ":blocks":
+		r.printMarkedBlocks()
+	case ":help":
+		_, _ = fmt.Fprintln(r.output, replHelp)
+	case ":quit", ":q":
+		return false
+	default:
+		_, _ = fmt.Fprintln(r.output, "Unknown command", name+". Type :help for help")
+	}
+	return true
+}
+
+// luaChunkIncomplete checks whether the lua code ends in the middle of a statement, so more lines are expected.
+// Expressions like "x" are not statements, so they are checked as return values first, the same way executeLua runs them
+func luaChunkIncomplete(code string) bool {
+	if _, err := parse.Parse(strings.NewReader("return "+code), replFileName); err == nil {
+		return false
+	}
+	_, err := parse.Parse(strings.NewReader(code), replFileName)
+	parseError, ok := err.(*parse.Error)
+	return ok && parseError.Pos.Line == parse.EOF
+}
+
+// executeText processes the text as input file and prints the result. Tokens are not written to the output,
+// so lua code of the next lines can still write to blocks marked in this one
+func (r *Repl) executeText(text string) {
+	p := r.processor
+	err := runProcessing(func() {
+		tokens := newLexer(text, replFileName).tokenize()
+		p.executeTokens(tokens)
+		var result strings.Builder
+		for i := tokens.first(); i != noToken; i = tokens.next(i) {
+			token := tokens.get(i)
+			if !(token.tokenType == LUA_BLOCK_START || token.tokenType == LUA_BLOCK_END || token.tokenType == LuaBlock) {
+				result.WriteString(token.text())
+			}
+		}
+		_, _ = fmt.Fprint(r.output, result.String())
+	})
+	if err != nil {
+		_, _ = fmt.Fprintln(r.output, err.Error())
+	}
+}
+
+// executeLua executes the lua code and prints text written with echo and values of the expression, like lua interpreter does
+func (r *Repl) executeLua(code string) {
+	p := r.processor
+	L := p.luaState
+	err := runProcessing(func() {
+		function, err := loadLuaChunk(L, "return "+code, replFileName, 0)
+		if err != nil {
+			function, err = loadLuaChunk(L, code, replFileName, 0)
+		}
+		if err != nil {
+			reportError(nil, "%s", err.Error())
+		}
+		echoToken := &Token{tokenType: SYMBOL, source: &SourceFile{path: replFileName}}
+		L.SetGlobal("currentBlock", createUserDataFromToken(echoToken, L))
+
+		top := L.GetTop()
+		L.Push(function)
+		if err := L.PCall(0, lua.MultRet, nil); err != nil {
+			reportError(nil, "%s", p.describeLuaError(err))
+		}
+		var values []string
+		for i := top + 1; i <= L.GetTop(); i++ {
+			values = append(values, L.ToStringMeta(L.Get(i)).String())
+		}
+		L.SetTop(top)
+
+		if text := echoToken.text(); text != "" {
+			_, _ = fmt.Fprintln(r.output, strings.TrimSuffix(text, "\n"))
+		}
+		if len(values) != 0 {
+			_, _ = fmt.Fprintln(r.output, strings.Join(values, "\t"))
+		}
+	})
+	if err != nil {
+		_, _ = fmt.Fprintln(r.output, err.Error())
+	}
+}
+
+func (r *Repl) printMarkedBlocks() {
+	var names []string
+	for name := range r.processor.markedBlocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, _ = fmt.Fprintf(r.output, "%s: [%s]\n", name, escapeStringForDebugPrint(r.processor.markedBlocks[name].text()))
+	}
+}
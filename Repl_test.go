@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReplLuaExpressionsAndCancel(t *testing.T) {
+	processor, err := newProcessor(nil)
+	defer processor.close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	processor.outputs = newOutputSet("console")
+	processor.resetOutputStack()
+
+	var output strings.Builder
+	repl := &Repl{processor: processor, output: &output}
+	repl.run(strings.NewReader(":lua\nx = 5\nx\nif x then\n:cancel\nprint(x + 1)\n:text\na <?lua echo(x) lua?> b\n"))
+	for _, expected := range []string{"lua> 5\n", "...> lua> ", "tpl> a 5 b\n"} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("Output does not contain [%s]\n%s", escapeStringForDebugPrint(expected), output.String())
+		}
+	}
+	if strings.Contains(output.String(), "error") {
+		t.Errorf("Unexpected error\n%s", output.String())
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/yuin/gopher-lua"
+)
+
+// sandboxMode removes lua functions that can change files or run processes
+var sandboxMode = false
+
+// unsafe functions of the os library. Functions that only read time or environment are kept
+var sandboxRemovedOsFunctions = []string{"execute", "exit", "remove", "rename", "setenv", "tmpname"}
+
+// applySandbox removes unsafe functions. The io library is removed from package.loaded and package.preload too,
+// otherwise require("io") would return it
+func applySandbox(luaState *lua.LState) {
+	luaState.SetGlobal("io", lua.LNil)
+	for _, tableName := range []string{"loaded", "preload"} {
+		if packageTable, ok := luaState.GetField(luaState.GetGlobal("package"), tableName).(*lua.LTable); ok {
+			packageTable.RawSetString("io", lua.LNil)
+		}
+	}
+	if osTable, ok := luaState.GetGlobal("os").(*lua.LTable); ok {
+		for _, name := range sandboxRemovedOsFunctions {
+			osTable.RawSetString(name, lua.LNil)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSandboxRemovesIoLibrary(t *testing.T) {
+	sandboxMode = true
+	defer func() { sandboxMode = false }()
+	processor, err := newProcessor(nil)
+	defer processor.close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, code := range []string{`assert(io == nil)`, `assert(package.loaded.io == nil)`, `assert(os.execute == nil)`} {
+		if err := processor.runLuaChunk(code, "test.lua", 0); err != nil {
+			t.Errorf("[%s] failed\n%s", code, processor.describeLuaError(err))
+		}
+	}
+	if err := processor.runLuaChunk(`require("io")`, "test.lua", 0); err == nil {
+		t.Error("require(\"io\") should fail in sandbox")
+	}
+}
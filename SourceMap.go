@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// sourceMapPath is the file where the source map is written. Source map is not collected when it is empty
+var sourceMapPath string
+
+// Producer is a macro invocation or a lua block that wrote text to the output
+type Producer struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name,omitempty"`
+	Source string `json:"source"`
+	Line   int    `json:"line"`
+}
+
+// SourceMapSegment maps a column range of one output line to its origin. Lines are 1-based, columns are 0-based byte offsets, endColumn is exclusive
+type SourceMapSegment struct {
+	Line        int       `json:"line"`
+	StartColumn int       `json:"startColumn"`
+	EndColumn   int       `json:"endColumn"`
+	Source      string    `json:"source"`
+	SourceLine  int       `json:"sourceLine"`
+	Producer    *Producer `json:"producer,omitempty"`
+}
+
+type OutputSourceMap struct {
+	File     string             `json:"file"`
+	Mappings []SourceMapSegment `json:"mappings"`
+	//position where the next text is written, 0-based
+	line       int
+	column     int
+	lineMapped bool
+}
+
+// SourceMap holds maps of all outputs in order of the first write
+type SourceMap struct {
+	Version int                `json:"version"`
+	Outputs []*OutputSourceMap `json:"outputs"`
+	outputs map[string]*OutputSourceMap
+}
+
+func newOutputSourceMap(filePath string) *OutputSourceMap {
+	if sourceMapPath == "" {
+		return nil
+	}
+	return &OutputSourceMap{File: filePath, Mappings: []SourceMapSegment{}}
+}
+
+// newProducer creates producer of the text written by lua code. Generated text is attributed to the line of its producer
+func (p *Processor) newProducer(kind string, name string, token *Token) *Producer {
+	return &Producer{kind, name, token.inputFile(), int(token.lineIndex) + 1}
+}
+
+// add records text written to the output. Text of the source file moves to the next source line on every new line,
+// text written by lua code is attributed to the line of its producer. Text without source, like line information, is not mapped
+func (m *OutputSourceMap) add(text string, source string, sourceLineIndex int, producer *Producer) {
+	for {
+		newLineIndex := strings.IndexByte(text, '\n')
+		part := text
+		if newLineIndex != -1 {
+			part = text[:newLineIndex]
+		}
+		//empty line gets empty segment, so every line of the output is mapped
+		if source != "" && (len(part) > 0 || (newLineIndex != -1 && !m.lineMapped)) {
+			m.addSegment(len(part), source, sourceLineIndex, producer)
+		}
+		m.column += len(part)
+		if newLineIndex == -1 {
+			return
+		}
+
+		m.line++
+		m.column = 0
+		m.lineMapped = false
+		if producer == nil {
+			sourceLineIndex++
+		}
+		text = text[newLineIndex+1:]
+	}
+}
+
+func (m *OutputSourceMap) addSegment(length int, source string, sourceLineIndex int, producer *Producer) {
+	m.lineMapped = true
+	if len(m.Mappings) > 0 {
+		last := &m.Mappings[len(m.Mappings)-1]
+		if last.Line == m.line+1 && last.EndColumn == m.column && last.Source == source && last.SourceLine == sourceLineIndex+1 && last.Producer == producer {
+			last.EndColumn += length
+			return
+		}
+	}
+	m.Mappings = append(m.Mappings, SourceMapSegment{m.line + 1, m.column, m.column + length, source, sourceLineIndex + 1, producer})
+}
+
+func newSourceMap() *SourceMap {
+	return &SourceMap{Version: 1, Outputs: []*OutputSourceMap{}, outputs: make(map[string]*OutputSourceMap)}
+}
+
+// addOutputs appends maps of the job outputs. Outputs shared by several jobs continue after the text written by previous jobs
+func (s *SourceMap) addOutputs(outputs *OutputSet) {
+	s.append(outputs.targets[mainOutputName].sourceMap)
+	for _, name := range outputs.order {
+		s.append(outputs.targets[name].sourceMap)
+	}
+}
+
+func (s *SourceMap) append(outputMap *OutputSourceMap) {
+	if outputMap == nil {
+		return
+	}
+	existing, exists := s.outputs[outputMap.File]
+	if !exists {
+		s.outputs[outputMap.File] = outputMap
+		s.Outputs = append(s.Outputs, outputMap)
+		return
+	}
+
+	for _, segment := range outputMap.Mappings {
+		if segment.Line == 1 {
+			segment.StartColumn += existing.column
+			segment.EndColumn += existing.column
+		}
+		segment.Line += existing.line
+		existing.Mappings = append(existing.Mappings, segment)
+	}
+	if outputMap.line == 0 {
+		existing.column += outputMap.column
+	} else {
+		existing.column = outputMap.column
+	}
+	existing.line += outputMap.line
+}
+
+func writeSourceMapFile(sourceMap *SourceMap) {
+	content, err := json.MarshalIndent(sourceMap, "", "  ")
+	if err != nil {
+		reportError(nil, "Cannot create source map\n%s", err.Error())
+	}
+	content = append(content, '\n')
+	if isConsolePath(sourceMapPath) {
+		_, _ = os.Stdout.Write(content)
+		return
+	}
+
+	file := createOutputFile(sourceMapPath)
+	defer file.Close()
+	if _, err := file.Write(content); err != nil {
+		reportError(nil, "Cannot write source map %s\n%s", sourceMapPath, err.Error())
+	}
+}
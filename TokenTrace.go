@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+)
+
+// tokenTraceFormat is "text" or "json" when token lists are traced. Empty string disables tracing
+var tokenTraceFormat = ""
+var tokenTraceWriter io.Writer = os.Stderr
+
+// tokensExecuted is set when the tokens command shows token lists after lua blocks and macros were executed too
+var tokensExecuted = false
+
+// jobs are processed in parallel, but every dump is written at once
+var tokenTraceMutex sync.Mutex
+
+// TokenDump is the token list of the input file as it is shown by --trace-tokens and the tokens command
+type TokenDump struct {
+	File   string           `json:"file"`
+	Phase  string           `json:"phase"`
+	Tokens []TokenDumpEntry `json:"tokens"`
+}
+
+type TokenDumpEntry struct {
+	Index   int    `json:"index"`
+	Type    string `json:"type"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Value   string `json:"value"`
+	Removed bool   `json:"removed,omitempty"`
+}
+
+func resolveTokenTraceFormat(value string) string {
+	if value != "text" && value != "json" {
+		fail("Token trace format should be text or json, but found", value)
+	}
+	return value
+}
+
+// traceTokens writes the token list of the file, when tracing is enabled. Phase is "before" or "after" execution of lua blocks and macros.
+// Removed tokens are shown after execution only, because before it they are not removed yet
+func traceTokens(tokens *TokenList, file string, phase string) {
+	if tokenTraceFormat == "" {
+		return
+	}
+	dump := TokenDump{File: file, Phase: phase, Tokens: []TokenDumpEntry{}}
+	for i := tokens.firstIndex; i < tokens.len(); i++ {
+		token := tokens.get(i)
+		dump.Tokens = append(dump.Tokens, TokenDumpEntry{i, token.typeName(), token.inputFile(), int(token.lineIndex) + 1, token.column(), token.text(), token.removed})
+	}
+
+	var content bytes.Buffer
+	if tokenTraceFormat == "json" {
+		//token text is full of '<' and '>', which are escaped by default
+		encoder := json.NewEncoder(&content)
+		encoder.SetEscapeHTML(false)
+		_ = encoder.Encode(dump)
+	} else {
+		writeTokenDumpText(&content, dump)
+	}
+
+	tokenTraceMutex.Lock()
+	defer tokenTraceMutex.Unlock()
+	_, _ = tokenTraceWriter.Write(content.Bytes())
+}
+
+func writeTokenDumpText(output io.Writer, dump TokenDump) {
+	_, _ = fmt.Fprintf(output, "tokens of %s %s execution:\n", dump.File, dump.Phase)
+	writer := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	for _, entry := range dump.Tokens {
+		state := ""
+		if entry.Removed {
+			state = "\tremoved"
+		}
+		_, _ = fmt.Fprintf(writer, "%d\t%s\t%s:%d:%d\t[%s]%s\n", entry.Index, entry.Type, entry.File, entry.Line, entry.Column, escapeStringForDebugPrint(entry.Value), state)
+	}
+	_ = writer.Flush()
+}
+
+// tokensCommand prints token lists of inputs. Lua blocks are executed only when token lists after execution are requested
+func tokensCommand(arguments []string) {
+	loadInputs(arguments)
+	jobs := createAllProcessingJobs()
+	if tokenTraceFormat == "" {
+		tokenTraceFormat = "text"
+	}
+	tokenTraceWriter = os.Stdout
+
+	if tokensExecuted {
+		discardOutputs = true
+		if _, err := processFiles(luaFiles, jobs); err != nil {
+			fail(err.Error())
+		}
+		return
+	}
+
+	processor, err := newProcessor(nil)
+	defer processor.close()
+	if err != nil {
+		fail(err.Error())
+	}
+	for _, job := range jobs {
+		for _, file := range job.inputs {
+			err := runProcessing(func() {
+				tokens := newLexer(processor.readFile(file), inputDisplayName(file)).tokenize()
+				traceTokens(tokens, inputDisplayName(file), "before")
+			})
+			if err != nil {
+				fail(err.Error())
+			}
+		}
+	}
+}
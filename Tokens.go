@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	EOF             = -1
+	WHITESPACE      = 1
+	SYMBOL          = 2
+	LUA_BLOCK_START = 3
+	LUA_BLOCK_END   = 4
+	LuaBlock        = 5
+	SPECIAL         = 6
+	UNKNOWN         = 7
+	NUMBER          = 8
+	ESCAPE          = 9
+)
+
+var tokenTypeNames = map[int8]string{
+	WHITESPACE:      "WHITESPACE",
+	SYMBOL:          "SYMBOL",
+	LUA_BLOCK_START: "LUA_BLOCK_START",
+	LUA_BLOCK_END:   "LUA_BLOCK_END",
+	LuaBlock:        "LUA_BLOCK",
+	SPECIAL:         "SPECIAL",
+	UNKNOWN:         "UNKNOWN",
+	NUMBER:          "NUMBER",
+	ESCAPE:          "ESCAPE",
+}
+
+// noToken is returned by TokenList navigation functions when there are no more tokens
+const noToken = -1
+
+// tokenPageSize is the number of tokens in one page of TokenList. Pages are never reallocated, so pointers to tokens stay valid
+const tokenPageSize = 4096
+
+type SourceFile struct {
+	path    string
+	content string
+}
+
+// Token is a span of the source file. Tokens are stored by value in TokenList, so tokenizing does not allocate memory per token.
+// Fields are kept small, because big files have millions of tokens
+type Token struct {
+	tokenType int8
+	removed   bool
+	//set when the token was written to the output. Streaming mode does not allow to change such tokens
+	written   bool
+	start     int32
+	end       int32
+	lineIndex int32
+	source    *SourceFile
+	//text written by lua code. When it is set, it replaces the source text of the token
+	overlay *Overlay
+	output  string
+}
+
+// Overlay is kept as list of chunks, because appending to the string makes every write copy the whole block
+type Overlay struct {
+	chunks []string
+	//producer of every chunk, nil for the source text. Allocated on the first chunk written by lua code
+	producers []*Producer
+	//output of every chunk, empty for the output of the token. Allocated on the first chunk written while the output was diverted
+	outputs []string
+}
+
+type TokenList struct {
+	pages  [][]Token
+	length int
+	//index of the first token that was not written to the output yet. Pages before it can be released
+	firstIndex int
+	//streaming lexer, which reads more tokens when the list reaches its end
+	lexer *Lexer
+}
+
+func (token *Token) String() string {
+	return fmt.Sprintf("%d-\"%s\"", token.tokenType, token.text())
+}
+
+func (token *Token) typeName() string {
+	name, exists := tokenTypeNames[token.tokenType]
+	if !exists {
+		return fmt.Sprintf("TYPE_%d", token.tokenType)
+	}
+	return name
+}
+
+func (token *Token) inputFile() string {
+	return token.source.path
+}
+
+// column returns 1-based byte column of the token start. Streaming lexer starts chunks in the middle of lines, so columns are known only for files read at once
+func (token *Token) column() int {
+	return int(token.start) - strings.LastIndexByte(token.source.content[:token.start], '\n')
+}
+
+func (token *Token) sourceText() string {
+	return token.source.content[token.start:token.end]
+}
+
+// replaceText hides the source text of the token, so only text written by lua code is left
+func (token *Token) replaceText() {
+	token.overlay = new(Overlay)
+}
+
+// appendText appends text written by lua code. Empty output means the output of the token
+func (token *Token) appendText(text string, producer *Producer, output string) {
+	if token.overlay == nil {
+		token.overlay = new(Overlay)
+		if token.start != token.end {
+			token.overlay.chunks = append(token.overlay.chunks, token.sourceText())
+		}
+	}
+	if text != "" {
+		token.overlay.add(text, producer, output)
+	}
+}
+
+func (overlay *Overlay) add(text string, producer *Producer, output string) {
+	if producer != nil && overlay.producers == nil {
+		overlay.producers = make([]*Producer, len(overlay.chunks), cap(overlay.chunks))
+	}
+	if output != "" && overlay.outputs == nil {
+		overlay.outputs = make([]string, len(overlay.chunks), cap(overlay.chunks))
+	}
+	overlay.chunks = append(overlay.chunks, text)
+	if overlay.producers != nil {
+		overlay.producers = append(overlay.producers, producer)
+	}
+	if overlay.outputs != nil {
+		overlay.outputs = append(overlay.outputs, output)
+	}
+}
+
+// chunkOutput returns the output where the chunk of the token text is written
+func (token *Token) chunkOutput(chunkIndex int) string {
+	if token.overlay == nil || token.overlay.outputs == nil || token.overlay.outputs[chunkIndex] == "" {
+		return token.output
+	}
+	return token.overlay.outputs[chunkIndex]
+}
+
+// producer returns producer of the chunk of the token text. nil means that the chunk is the source text
+func (token *Token) producer(chunkIndex int) *Producer {
+	if token.overlay == nil || token.overlay.producers == nil {
+		return nil
+	}
+	return token.overlay.producers[chunkIndex]
+}
+
+// text returns the text of the token that is written to the output
+func (token *Token) text() string {
+	if token.overlay == nil {
+		return token.sourceText()
+	}
+	if len(token.overlay.chunks) == 1 {
+		return token.overlay.chunks[0]
+	}
+	var result strings.Builder
+	for _, chunk := range token.overlay.chunks {
+		result.WriteString(chunk)
+	}
+	return result.String()
+}
+
+// textChunks returns the text of the token without joining chunks written by lua code
+func (token *Token) textChunks() []string {
+	if token.overlay == nil {
+		return []string{token.sourceText()}
+	}
+	return token.overlay.chunks
+}
+
+func newTokenList() *TokenList {
+	return new(TokenList)
+}
+
+func (l *TokenList) add(token Token) *Token {
+	pageIndex := l.length / tokenPageSize
+	if pageIndex == len(l.pages) {
+		l.pages = append(l.pages, make([]Token, 0, tokenPageSize))
+	}
+	l.pages[pageIndex] = append(l.pages[pageIndex], token)
+	l.length++
+	return l.get(l.length - 1)
+}
+
+func (l *TokenList) get(index int) *Token {
+	return &l.pages[index/tokenPageSize][index%tokenPageSize]
+}
+
+func (l *TokenList) len() int {
+	return l.length
+}
+
+// first returns index of the first token that was not removed or released
+func (l *TokenList) first() int {
+	return l.skipRemoved(l.firstIndex)
+}
+
+// next returns index of the next token that was not removed
+func (l *TokenList) next(index int) int {
+	if index == noToken {
+		return noToken
+	}
+	return l.skipRemoved(index + 1)
+}
+
+func (l *TokenList) skipRemoved(index int) int {
+	for ; index < l.length || l.readMore(); index++ {
+		if !l.get(index).removed {
+			return index
+		}
+	}
+	return noToken
+}
+
+// readMore asks the streaming lexer for the next token. Returns false if there are no more tokens
+func (l *TokenList) readMore() bool {
+	if l.lexer == nil {
+		return false
+	}
+	if !l.lexer.readNextToken() {
+		l.lexer = nil
+		return false
+	}
+	return true
+}
+
+// release drops tokens before the index, so memory used by them and by their source chunks can be freed
+func (l *TokenList) release(index int) {
+	for pageIndex := l.firstIndex / tokenPageSize; (pageIndex+1)*tokenPageSize <= index; pageIndex++ {
+		l.pages[pageIndex] = nil
+	}
+	l.firstIndex = index
+}
+
+// remove excludes the token from the output and returns index of the next token
+func (l *TokenList) remove(index int) int {
+	l.get(index).removed = true
+	return l.next(index)
+}
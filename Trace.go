@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceEnabled is set by --trace. Entries are written to traceFilePath, or to stderr when it is empty
+var traceEnabled = false
+var traceFilePath = ""
+
+// traceWriter is opened by openTraceLog. nil means that tracing is disabled
+var traceWriter io.Writer
+
+// jobs are processed in parallel, but every entry is written at once
+var traceMutex sync.Mutex
+
+func openTraceLog() {
+	if !traceEnabled {
+		return
+	}
+	if traceFilePath == "" {
+		traceWriter = os.Stderr
+		return
+	}
+	file, err := os.Create(traceFilePath)
+	if err != nil {
+		fail("Cannot create trace file", traceFilePath, err.Error())
+	}
+	traceWriter = file
+}
+
+// beginTrace starts collecting text written by the current producer and returns the start time of its execution
+func (p *Processor) beginTrace() time.Time {
+	if traceWriter == nil {
+		return time.Time{}
+	}
+	p.emittedText.Reset()
+	return time.Now()
+}
+
+// trace writes the entry about executed lua block, or about expanded macro when macro is provided:
+// a.tpl:3:5: macro NAME("arg", {"variadic", "arg"}) emitted "text" in 15µs
+func (p *Processor) trace(token *Token, macro *MacroStruct, arguments []interface{}, startTime time.Time) {
+	if traceWriter == nil {
+		return
+	}
+	duration := time.Since(startTime)
+
+	var entry strings.Builder
+	_, _ = fmt.Fprintf(&entry, "%s:%d:%d: ", token.inputFile(), token.lineIndex+1, token.column())
+	if macro == nil {
+		entry.WriteString("lua block")
+	} else {
+		_, _ = fmt.Fprintf(&entry, "macro %s(%s)", macro.name, formatTraceArguments(arguments))
+	}
+	_, _ = fmt.Fprintf(&entry, " emitted %s in %s\n", strconv.Quote(p.emittedText.String()), duration)
+
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	_, _ = io.WriteString(traceWriter, entry.String())
+}
+
+// formatTraceArguments formats arguments as lua values: raw arguments as strings and variadic arguments as table
+func formatTraceArguments(arguments []interface{}) string {
+	var result []string
+	for _, argument := range arguments {
+		switch value := argument.(type) {
+		case string:
+			result = append(result, strconv.Quote(value))
+		case []string:
+			var values []string
+			for _, variadicValue := range value {
+				values = append(values, strconv.Quote(variadicValue))
+			}
+			result = append(result, "{"+strings.Join(values, ", ")+"}")
+		}
+	}
+	return strings.Join(result, ", ")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	warningUnusedBlock   = "unused-block"
+	warningUnusedMacro   = "unused-macro"
+	warningLateMark      = "late-mark"
+	warningEmptyLuaBlock = "empty-lua-block"
+	warningShiftedLines  = "shifted-lines"
+)
+
+// enabledWarnings holds warning categories and whether they are reported. Categories that are noisy for usual templates are disabled by default
+var enabledWarnings = map[string]bool{
+	warningUnusedBlock:   true,
+	warningUnusedMacro:   true,
+	warningLateMark:      true,
+	warningEmptyLuaBlock: false,
+	warningShiftedLines:  true,
+}
+
+// warningsAsErrors is set by -Werror. Jobs with warnings fail
+var warningsAsErrors = false
+
+type Warning struct {
+	category string
+	file     string
+	line     int
+	message  string
+}
+
+type SourceLocation struct {
+	file string
+	line int
+}
+
+func (warning Warning) String() string {
+	return fmt.Sprintf("Warning at %s:%d\n%s [-W%s]", warning.file, warning.line, warning.message, warning.category)
+}
+
+// setWarningOption applies -W flag: category name enables it, no-NAME disables it, all enables every category and error turns warnings into errors
+func setWarningOption(value string) {
+	if value == "error" {
+		warningsAsErrors = true
+		return
+	}
+	if value == "all" {
+		for category := range enabledWarnings {
+			enabledWarnings[category] = true
+		}
+		return
+	}
+	category := strings.TrimPrefix(value, "no-")
+	if _, exists := enabledWarnings[category]; !exists {
+		fail("Unknown warning", value+". Known warnings:", strings.Join(warningCategories(), ", "))
+	}
+	enabledWarnings[category] = !strings.HasPrefix(value, "no-")
+}
+
+func warningCategories() []string {
+	var categories []string
+	for category := range enabledWarnings {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+func (p *Processor) warn(category string, file string, line int, format string, args ...interface{}) {
+	if enabledWarnings[category] {
+		p.warnings = append(p.warnings, Warning{category, file, line, fmt.Sprintf(format, args...)})
+	}
+}
+
+func (p *Processor) warnAtToken(category string, token *Token, format string, args ...interface{}) {
+	p.warn(category, token.inputFile(), int(token.lineIndex)+1, format, args...)
+}
+
+// checkJobWarnings finds problems that are known only when all inputs of the job were processed
+func (p *Processor) checkJobWarnings() {
+	var blockNames []string
+	for name := range p.markedBlocks {
+		blockNames = append(blockNames, name)
+	}
+	sort.Strings(blockNames)
+	for _, name := range blockNames {
+		token := p.markedBlocks[name]
+		//text of marked blocks is written only by lua code, so the overlay has chunks only if something was written
+		if token.overlay == nil || len(token.overlay.chunks) == 0 {
+			p.warnAtToken(warningUnusedBlock, token, "Marked block [%s] never receives text", name)
+		}
+		if location, exists := p.missedBlockLookups[name]; exists {
+			p.warn(warningLateMark, location.file, location.line, "getMarkedBlock is called for block [%s] before it is marked at %s:%d", name, token.inputFile(), token.lineIndex+1)
+		}
+	}
+
+	for _, description := range describeMacros(p.macroMap) {
+		//macros of lua files are shared by all jobs, so only macros declared in inputs of the job are expected to be used in it
+		if _, declaredInLibrary := p.librariesMacroMap[description.Name]; declaredInLibrary || p.usedMacros[description.Name] {
+			continue
+		}
+		p.warn(warningUnusedMacro, description.File, description.Line, "Macro [%s] is declared but never used", description.Name)
+	}
+}
+
+// collectWarnings logs warnings of the job and returns the error when warnings are treated as errors
+func collectWarnings(warnings []Warning) *ProcessingError {
+	for _, warning := range warnings {
+		log(warning.String())
+	}
+	if warningsAsErrors && len(warnings) != 0 {
+		return &ProcessingError{message: fmt.Sprintf("Warnings are treated as errors: %d", len(warnings))}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+const watchPollInterval = 500 * time.Millisecond
+
+type fileState struct {
+	exists           bool
+	size             int64
+	modificationTime time.Time
+}
+
+func readFileState(filePath string) fileState {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{true, info.Size(), info.ModTime()}
+}
+
+func readFileStates(filePaths []string) map[string]fileState {
+	states := make(map[string]fileState, len(filePaths))
+	for _, filePath := range filePaths {
+		states[filePath] = readFileState(filePath)
+	}
+	return states
+}
+
+// watchFiles processes files and then reprocesses them every time one of the used files changes. It never returns.
+// States of known files are read before processing, so changes made while files are processed start the next cycle.
+// Inputs are expanded again in every cycle, so files added to watched directories and glob patterns are processed too
+func watchFiles(luaFiles []string, jobs []ProcessingJob) {
+	var knownFiles []string
+	for {
+		//lua and input files are watched even if processing failed before they were read
+		watchedFiles := append([]string{}, luaFiles...)
+		watchedFiles = append(watchedFiles, inputDirectories(inputPaths())...)
+		watchedFiles = append(watchedFiles, knownFiles...)
+		watchedFiles = append(watchedFiles, jobInputs(jobs)...)
+		states := readFileStates(watchedFiles)
+		dependencyFiles, err := processFiles(luaFiles, jobs)
+		if err != nil {
+			log(err.Error())
+		}
+		//files that were first read in this cycle could change only while they were processed
+		for _, filePath := range dependencyFiles {
+			if _, exists := states[filePath]; !exists {
+				states[filePath] = readFileState(filePath)
+			}
+		}
+		knownFiles = dependencyFiles
+
+		log("Watching", len(states), "files for changes")
+		for {
+			waitForChanges(states)
+			log("Change detected, processing files again")
+			if jobs, err = recreateProcessingJobs(); err == nil {
+				break
+			}
+			log(err.Error())
+			states = readFileStates(append(append([]string{}, luaFiles...), inputDirectories(inputPaths())...))
+		}
+	}
+}
+
+func jobInputs(jobs []ProcessingJob) []string {
+	var inputs []string
+	for _, job := range jobs {
+		inputs = append(inputs, job.inputs...)
+	}
+	return inputs
+}
+
+// recreateProcessingJobs expands inputs again. Errors like missing inputs are returned instead of stopping the watch
+func recreateProcessingJobs() (jobs []ProcessingJob, err *ProcessingError) {
+	failuresRecoverable = true
+	defer func() { failuresRecoverable = false }()
+	err = runProcessing(func() {
+		jobs = createAllProcessingJobs()
+		checkDependencyFileOutputs(jobs)
+	})
+	return jobs, err
+}
+
+func waitForChanges(states map[string]fileState) {
+	for {
+		time.Sleep(watchPollInterval)
+		for filePath, state := range states {
+			if readFileState(filePath) != state {
+				return
+			}
+		}
+	}
+}